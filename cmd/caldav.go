@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// caldavPasswordEnv names the environment variable the CalDAV password is read from
+const caldavPasswordEnv = "EIGHTRINKS_CALDAV_PASSWORD"
+
+// caldavQuery asks a collection for the ETag and data of every VEVENT in it
+const caldavQuery = `<?xml version="1.0" encoding="utf-8"?>
+<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop>
+    <d:getetag/>
+    <c:calendar-data/>
+  </d:prop>
+  <c:filter>
+    <c:comp-filter name="VCALENDAR">
+      <c:comp-filter name="VEVENT"/>
+    </c:comp-filter>
+  </c:filter>
+</c:calendar-query>
+`
+
+// caldavSink keeps a CalDAV calendar collection, such as a Nextcloud or Radicale
+// calendar, in step with the schedule. Each game is a resource holding a single
+// VEVENT, and updates and deletes are conditional on the ETag it was listed with
+// so that a resource changed on the server in the meantime isn't overwritten.
+type caldavSink struct {
+	unbuffered
+	URL      string // the collection, ending in a slash
+	Username string
+	Password string
+	Auth     string // basic, digest, or auto to answer whatever the server asks for
+	Client   *http.Client
+
+	resources map[string]davResource // by href, filled in by List
+	digest    *digestChallenge       // the last digest challenge, once there has been one
+}
+
+// davResource is what a listed resource holds and its version
+type davResource struct {
+	Name string // the event name in the UID of its event
+	ETag string
+}
+
+// newCalDAVSink returns a sink for the calendar collection at collectionURL
+func newCalDAVSink(collectionURL string, username string, password string, auth string) (*caldavSink, error) {
+
+	switch auth {
+	case "auto", "basic", "digest":
+	default:
+		return nil, fmt.Errorf("unknown CalDAV auth %s, expected basic, digest or auto", auth)
+	}
+	u, err := url.Parse(collectionURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid CalDAV collection URL %q", collectionURL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &caldavSink{
+		URL:       u.String(),
+		Username:  username,
+		Password:  password,
+		Auth:      auth,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		resources: make(map[string]davResource),
+	}, nil
+}
+
+func (s *caldavSink) Name() string {
+	return "caldav:" + s.URL
+}
+
+// List returns the team's events in the collection that the sync created, each
+// with the href of its resource as its ID
+func (s *caldavSink) List(ctx context.Context, teamID string) ([]calendarEvent, error) {
+
+	header := http.Header{
+		"Content-Type": {"application/xml; charset=utf-8"},
+		"Depth":        {"1"},
+	}
+	resp, err := s.do(ctx, "REPORT", s.URL, header, []byte(caldavQuery))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, davError("listing events", resp)
+	}
+
+	var ms struct {
+		Responses []struct {
+			Href     string `xml:"href"`
+			Propstat []struct {
+				Status string `xml:"status"`
+				Prop   struct {
+					ETag         string `xml:"getetag"`
+					CalendarData string `xml:"calendar-data"`
+				} `xml:"prop"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("error parsing events of %s, %v", s.URL, err)
+	}
+
+	var events []calendarEvent
+	s.resources = make(map[string]davResource)
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.CalendarData == "" || !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			evs, err := readEvents(strings.NewReader(ps.Prop.CalendarData))
+			if err != nil {
+				return nil, fmt.Errorf("error reading %s, %v", r.Href, err)
+			}
+			// Resources the sync didn't write hold no event with its UIDs
+			href := s.resolve(r.Href)
+			for _, ev := range evs {
+				ev.ID = href
+				s.resources[href] = davResource{Name: eventName(ev), ETag: ps.Prop.ETag}
+				if forTeam(ev, teamID) {
+					events = append(events, ev)
+				}
+			}
+		}
+	}
+	return events, nil
+}
+
+// Upsert writes the event to its resource, provided it hasn't changed since it was
+// listed, or creates a resource for it named after the event if it has no ID. A
+// resource can't change the UID it holds, so an event synced before events had
+// teams is replaced by a new resource when it is tagged.
+func (s *caldavSink) Upsert(ctx context.Context, ev calendarEvent) error {
+
+	if res, ok := s.resources[ev.ID]; ok && res.Name != eventName(ev) {
+		if err := s.Delete(ctx, ev); err != nil {
+			return err
+		}
+		ev.ID = ""
+	}
+
+	var body bytes.Buffer
+	if err := writeResource(&body, ev, time.Now()); err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"text/calendar; charset=utf-8"}}
+	href := ev.ID
+	if href == "" {
+		href = s.URL + url.PathEscape(eventName(ev)) + ".ics"
+		header.Set("If-None-Match", "*")
+	} else if etag := s.resources[href].ETag; etag != "" {
+		header.Set("If-Match", etag)
+	}
+
+	resp, err := s.do(ctx, "PUT", href, header, body.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("%s was changed on the server since it was listed, sync again", href)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return davError("writing "+href, resp)
+	}
+	s.resources[href] = davResource{Name: eventName(ev), ETag: resp.Header.Get("ETag")}
+	return nil
+}
+
+// Delete deletes the resource of the event, provided it hasn't changed since it
+// was listed
+func (s *caldavSink) Delete(ctx context.Context, ev calendarEvent) error {
+
+	header := http.Header{}
+	if etag := s.resources[ev.ID].ETag; etag != "" {
+		header.Set("If-Match", etag)
+	}
+	resp, err := s.do(ctx, "DELETE", ev.ID, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return fmt.Errorf("%s was changed on the server since it was listed, sync again", ev.ID)
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return davError("deleting "+ev.ID, resp)
+	}
+	delete(s.resources, ev.ID)
+	return nil
+}
+
+// resolve returns the absolute URL of an href from a multistatus response
+func (s *caldavSink) resolve(href string) string {
+	base, err := url.Parse(s.URL)
+	if err != nil {
+		return href
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return href
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// do sends a request with the configured credentials. Basic credentials are sent
+// up front when asked for, otherwise the request is sent again to answer a
+// challenge from the server.
+func (s *caldavSink) do(ctx context.Context, method string, target string, header http.Header, body []byte) (*http.Response, error) {
+
+	send := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequest(method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := s.Client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error sending %s %s, %v", method, target, err)
+		}
+		return resp, nil
+	}
+
+	if s.Username == "" {
+		return send("")
+	}
+	resp, err := send(s.authorization(method, target))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Answer the challenge. A challenge to credentials that were just sent
+	// means they are wrong, unless the digest nonce merely went stale.
+	challenge := resp.Header.Get("WWW-Authenticate")
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	retry := false
+	switch {
+	case scheme == "digest" && s.Auth != "basic":
+		dc := parseDigestChallenge(challenge)
+		retry = s.digest == nil || dc.stale
+		s.digest = &dc
+	case scheme == "basic" && s.Auth == "auto":
+		s.Auth = "basic"
+		retry = true
+	}
+	if !retry {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return send(s.authorization(method, target))
+}
+
+// authorization returns the Authorization header for a request, if credentials
+// can be sent yet
+func (s *caldavSink) authorization(method string, target string) string {
+	switch {
+	case s.Auth == "basic":
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(s.Username, s.Password)
+		return req.Header.Get("Authorization")
+	case s.digest != nil:
+		return s.digest.authorization(s.Username, s.Password, method, target)
+	}
+	return ""
+}
+
+// digestChallenge is a Digest WWW-Authenticate challenge, RFC 7616. Only MD5 is
+// supported, which is what CalDAV servers offering digest use.
+type digestChallenge struct {
+	realm  string
+	nonce  string
+	opaque string
+	qop    string
+	stale  bool
+	count  int // requests answered with this nonce
+}
+
+// parseDigestChallenge parses the parameters of a Digest challenge
+func parseDigestChallenge(header string) digestChallenge {
+
+	params := make(map[string]string)
+	rest := strings.TrimSpace(header[len("Digest"):])
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			value, rest = rest[1:end+1], rest[end+1:]
+			if len(rest) > 0 {
+				rest = rest[1:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = strings.TrimSpace(rest[:end]), rest[end:]
+		}
+		params[name] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	dc := digestChallenge{
+		realm:  params["realm"],
+		nonce:  params["nonce"],
+		opaque: params["opaque"],
+		stale:  strings.EqualFold(params["stale"], "true"),
+	}
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			dc.qop = "auth"
+		}
+	}
+	return dc
+}
+
+// authorization answers the challenge for a request
+func (dc *digestChallenge) authorization(username string, password string, method string, target string) string {
+
+	uri := target
+	if u, err := url.Parse(target); err == nil {
+		uri = u.RequestURI()
+	}
+	ha1 := md5Hex(username + ":" + dc.realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+
+	dc.count++
+	nc := fmt.Sprintf("%08x", dc.count)
+	cnonce := make([]byte, 8)
+	rand.Read(cnonce)
+	cn := hex.EncodeToString(cnonce)
+
+	var response string
+	if dc.qop == "auth" {
+		response = md5Hex(ha1 + ":" + dc.nonce + ":" + nc + ":" + cn + ":auth:" + ha2)
+	} else {
+		response = md5Hex(ha1 + ":" + dc.nonce + ":" + ha2)
+	}
+
+	h := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5, response="%s"`,
+		username, dc.realm, dc.nonce, uri, response)
+	if dc.qop == "auth" {
+		h += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s"`, nc, cn)
+	}
+	if dc.opaque != "" {
+		h += fmt.Sprintf(`, opaque="%s"`, dc.opaque)
+	}
+	return h
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// davError describes an unexpected response from a CalDAV server
+func davError(doing string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("error %s, %s: %s", doing, resp.Status, strings.TrimSpace(string(body)))
+}
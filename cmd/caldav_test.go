@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCalDAV is a calendar collection at /cal/ that checks preconditions the way
+// a CalDAV server does. Requests are answered once auth accepts them.
+type fakeCalDAV struct {
+	mu        sync.Mutex
+	resources map[string]fakeResource // by path
+	version   int
+	requests  []string // method, path and precondition of every authorized request
+	auth      func(w http.ResponseWriter, r *http.Request) bool
+}
+
+type fakeResource struct {
+	data string
+	etag string
+}
+
+func newFakeCalDAV() *fakeCalDAV {
+	return &fakeCalDAV{resources: make(map[string]fakeResource)}
+}
+
+func (f *fakeCalDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.auth != nil && !f.auth(w, r) {
+		return
+	}
+	f.requests = append(f.requests, strings.TrimSpace(fmt.Sprintf("%s %s %s%s",
+		r.Method, r.URL.Path, r.Header.Get("If-Match"), r.Header.Get("If-None-Match"))))
+
+	res, exists := f.resources[r.URL.Path]
+	if m := r.Header.Get("If-Match"); m != "" && (!exists || m != res.etag) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	switch r.Method {
+	case "REPORT":
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">`)
+		for path, res := range f.resources {
+			fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:getetag>%s</d:getetag>`+
+				`<c:calendar-data><![CDATA[%s]]></c:calendar-data></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`,
+				path, res.etag, res.data)
+		}
+		fmt.Fprint(w, `</d:multistatus>`)
+	case "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		f.version++
+		f.resources[r.URL.Path] = fakeResource{data: string(b), etag: fmt.Sprintf(`"%d"`, f.version)}
+		w.Header().Set("ETag", f.resources[r.URL.Path].etag)
+		if exists {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "DELETE":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.resources, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// takeRequests returns the requests made since it was last called
+func (f *fakeCalDAV) takeRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := f.requests
+	f.requests = nil
+	return requests
+}
+
+func TestCalDAVSync(t *testing.T) {
+
+	ctx := context.Background()
+	dav := newFakeCalDAV()
+	dav.auth = func(w http.ResponseWriter, r *http.Request) bool {
+		if user, pass, ok := r.BasicAuth(); ok && user == "megpies" && pass == "secret" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	srv := httptest.NewServer(dav)
+	defer srv.Close()
+
+	sink, err := newCalDAVSink(srv.URL+"/cal", "megpies", "secret", "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	games := []game{testGame(kickoff, "4150", "4153"), testGame(kickoff.AddDate(0, 0, 7), "4153", "4152")}
+	assignGameKeys(nil, games, time.Time{})
+
+	if _, err := reconcile(ctx, sink, "4153", "733", games, false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"REPORT /cal/",
+		"PUT /cal/733-483-4150-4153-1+4153.ics *",
+		"PUT /cal/733-483-4152-4153-1+4153.ics *",
+	}
+	if got := dav.takeRequests(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got requests\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	data := dav.resources["/cal/733-483-4150-4153-1+4153.ics"].data
+	if strings.Contains(data, "METHOD:") || strings.Contains(data, "X-WR-CALNAME") {
+		t.Errorf("calendar object resource has calendar properties:\n%s", data)
+	}
+	if !strings.Contains(data, "UID:733-483-4150-4153-1+4153@8rinks-scraper") {
+		t.Errorf("calendar object resource is missing its UID:\n%s", data)
+	}
+
+	// The second game moves and the first is cancelled, each is conditional on
+	// the resource being as it was listed
+	games[1].StartTime = games[1].StartTime.Add(time.Hour)
+	games[0].Cancelled = true
+	if _, err := reconcile(ctx, sink, "4153", "733", games, false); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"REPORT /cal/",
+		`PUT /cal/733-483-4152-4153-1+4153.ics "2"`,
+		`DELETE /cal/733-483-4150-4153-1+4153.ics "1"`,
+	}
+	if got := dav.takeRequests(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got requests\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A resource changed on the server since it was listed isn't overwritten
+	events, err := sink.List(ctx, "4153")
+	if err != nil || len(events) != 1 {
+		t.Fatalf("listed %d events, %v", len(events), err)
+	}
+	dav.resources["/cal/733-483-4152-4153-1+4153.ics"] = fakeResource{data: "changed", etag: `"changed"`}
+	err = sink.Upsert(ctx, events[0])
+	if err == nil || !strings.Contains(err.Error(), "changed on the server") {
+		t.Errorf("got %v, want the precondition to fail", err)
+	}
+}
+
+func TestCalDAVDigestAuth(t *testing.T) {
+
+	const realm, nonce = "radicale", "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	dav := newFakeCalDAV()
+	var challenges int
+	dav.auth = func(w http.ResponseWriter, r *http.Request) bool {
+		h := r.Header.Get("Authorization")
+		if strings.HasPrefix(h, "Digest ") {
+			p := parseDigestChallenge(h)
+			params := make(map[string]string)
+			for _, kv := range strings.Split(h[len("Digest "):], ", ") {
+				if i := strings.Index(kv, "="); i > 0 {
+					params[kv[:i]] = strings.Trim(kv[i+1:], `"`)
+				}
+			}
+			ha1 := md5Hex("megpies:" + realm + ":secret")
+			ha2 := md5Hex(r.Method + ":" + r.URL.RequestURI())
+			want := md5Hex(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+			if p.realm == realm && params["response"] == want {
+				return true
+			}
+		}
+		challenges++
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth,auth-int", algorithm=MD5`, realm, nonce))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	srv := httptest.NewServer(dav)
+	defer srv.Close()
+
+	sink, err := newCalDAVSink(srv.URL+"/cal/", "megpies", "secret", "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	games := []game{testGame(time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation), "4150", "4153")}
+	assignGameKeys(nil, games, time.Time{})
+	if _, err := reconcile(context.Background(), sink, "4153", "733", games, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(dav.resources) != 1 {
+		t.Errorf("got %d resources, want 1", len(dav.resources))
+	}
+	if challenges != 1 {
+		t.Errorf("got %d challenges, want the first request only", challenges)
+	}
+
+	// Wrong credentials are challenged once and not retried
+	sink.Password = "wrong"
+	if _, err := sink.List(context.Background(), "4153"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("got %v, want 401", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// changeType is the kind of difference found between two scrapes of a team's schedule
+type changeType string
+
+const (
+	changeAdded           changeType = "added"
+	changeRemoved         changeType = "removed"
+	changeTimeMoved       changeType = "time_moved"
+	changeLocationChanged changeType = "location_changed"
+	changeOpponentChanged changeType = "opponent_changed"
+	changeHomeAwaySwapped changeType = "home_away_swapped"
+	changeScorePosted     changeType = "score_posted"
+)
+
+// change is a single difference between the stored schedule of a team and the one
+// just scraped. BeforeValue and AfterValue hold the value that changed, Before and
+// After hold the whole fixture as it was and as it is now. Before is nil for added
+// games and After is nil for removed ones.
+type change struct {
+	Type        changeType `json:"type"`
+	TeamID      string     `json:"team_id"`
+	BeforeValue string     `json:"before_value,omitempty"`
+	AfterValue  string     `json:"after_value,omitempty"`
+	Before      *game      `json:"before,omitempty"`
+	After       *game      `json:"after,omitempty"`
+}
+
+// changeTimeLayout is how game times are shown in change descriptions
+const changeTimeLayout = "Mon Jan 2, 3:04 PM"
+
+// String describes the change for the CLI
+func (c change) String() string {
+	g := c.After
+	if g == nil {
+		g = c.Before
+	}
+	fixture := fmt.Sprintf("%s @ %s", g.VisitingTeam, g.HomeTeam)
+	when := g.StartTime.In(leagueLocation).Format(changeTimeLayout)
+
+	switch c.Type {
+	case changeAdded:
+		return fmt.Sprintf("Added: %s on %s at %s", fixture, when, g.Location)
+	case changeRemoved:
+		return fmt.Sprintf("Cancelled: %s on %s", fixture, when)
+	case changeTimeMoved:
+		return fmt.Sprintf("Time moved: %s from %s to %s", fixture, c.BeforeValue, c.AfterValue)
+	case changeLocationChanged:
+		return fmt.Sprintf("Location changed: %s on %s from %s to %s", fixture, when, c.BeforeValue, c.AfterValue)
+	case changeOpponentChanged:
+		return fmt.Sprintf("Opponent changed: %s on %s, was playing %s, now playing %s", fixture, when, c.BeforeValue, c.AfterValue)
+	case changeHomeAwaySwapped:
+		return fmt.Sprintf("Home and away swapped: %s on %s, was %s, now %s", fixture, when, c.BeforeValue, c.AfterValue)
+	case changeScorePosted:
+		return fmt.Sprintf("Score posted: %s on %s, %s", fixture, when, c.AfterValue)
+	}
+	return fmt.Sprintf("%s: %s on %s", c.Type, fixture, when)
+}
+
+// detectChanges compares the stored schedule of a team with the one just scraped.
+//
+// Games are matched on their identity key first, which follows a fixture when it
+// is moved to another day. A team plays at most once a day, so games left over
+// are then matched on the day they are played, which catches a change of opponent.
+// The grid only lists games that have not been played yet, so stored games that
+// started before now are never reported as removed.
+func detectChanges(teamID string, prev []game, curr []game, now time.Time) []change {
+
+	var changes []change
+
+	prevByKey := make(map[string]game)
+	for _, g := range prev {
+		if g.Key != "" {
+			prevByKey[g.Key] = g
+		}
+	}
+	matched := make(map[string]bool)
+	var unmatched []game
+	for _, g := range curr {
+		before, ok := prevByKey[g.Key]
+		if !ok {
+			unmatched = append(unmatched, g)
+			continue
+		}
+		matched[g.Key] = true
+		changes = append(changes, compareGames(teamID, before, g)...)
+	}
+	var leftover []game
+	for _, g := range prev {
+		if g.Key == "" || !matched[g.Key] {
+			leftover = append(leftover, g)
+		}
+	}
+
+	prevByDay := gamesByDay(leftover)
+	currByDay := gamesByDay(unmatched)
+	for _, day := range sortedDays(prevByDay, currByDay) {
+		before, after := prevByDay[day], currByDay[day]
+		for i := 0; i < len(before) || i < len(after); i++ {
+			switch {
+			case i >= len(before):
+				g := after[i]
+				changes = append(changes, change{Type: changeAdded, TeamID: teamID, After: &g})
+			case i >= len(after):
+				g := before[i]
+				if g.StartTime.Before(now) {
+					continue
+				}
+				changes = append(changes, change{Type: changeRemoved, TeamID: teamID, Before: &g})
+			default:
+				changes = append(changes, compareGames(teamID, before[i], after[i])...)
+			}
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changeTime(changes[i]).Before(changeTime(changes[j]))
+	})
+	return changes
+}
+
+// changeTime is when the game of a change is played now, or was to be played if
+// it was removed
+func changeTime(c change) time.Time {
+	if c.After != nil {
+		return c.After.StartTime
+	}
+	return c.Before.StartTime
+}
+
+// compareGames returns the changes between two scrapes of the same fixture
+func compareGames(teamID string, before game, after game) []change {
+
+	var changes []change
+	add := func(t changeType, beforeValue string, afterValue string) {
+		b, a := before, after
+		changes = append(changes, change{
+			Type:        t,
+			TeamID:      teamID,
+			BeforeValue: beforeValue,
+			AfterValue:  afterValue,
+			Before:      &b,
+			After:       &a,
+		})
+	}
+
+	if !before.StartTime.Equal(after.StartTime) {
+		add(changeTimeMoved,
+			before.StartTime.In(leagueLocation).Format(changeTimeLayout),
+			after.StartTime.In(leagueLocation).Format(changeTimeLayout))
+	}
+	if before.Location != after.Location {
+		add(changeLocationChanged, before.Location, after.Location)
+	}
+	if before.opponent(teamID) != after.opponent(teamID) {
+		add(changeOpponentChanged, before.opponent(teamID), after.opponent(teamID))
+	}
+	if before.isHome(teamID) != after.isHome(teamID) {
+		add(changeHomeAwaySwapped, before.homeAway(teamID), after.homeAway(teamID))
+	}
+	if before.HomeScore != after.HomeScore || before.VisitingScore != after.VisitingScore {
+		if after.HomeScore != "" || after.VisitingScore != "" {
+			add(changeScorePosted, before.score(), after.score())
+		}
+	}
+	return changes
+}
+
+// score returns the score of the game as visiting-home, or an empty string if
+// no score has been posted
+func (g game) score() string {
+	if g.VisitingScore == "" && g.HomeScore == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s %s - %s %s", g.VisitingTeam, g.VisitingScore, g.HomeScore, g.HomeTeam)
+}
+
+// gamesByDay groups games by the day they are played in the league time zone,
+// each day's games in order of start time
+func gamesByDay(games []game) map[string][]game {
+	byDay := make(map[string][]game)
+	for _, g := range games {
+		day := g.StartTime.In(leagueLocation).Format("2006-01-02")
+		byDay[day] = append(byDay[day], g)
+	}
+	for _, games := range byDay {
+		sort.SliceStable(games, func(i, j int) bool {
+			return games[i].StartTime.Before(games[j].StartTime)
+		})
+	}
+	return byDay
+}
+
+// sortedDays returns the days found in any of the groups, in order
+func sortedDays(groups ...map[string][]game) []string {
+	seen := make(map[string]bool)
+	var days []string
+	for _, group := range groups {
+		for day := range group {
+			if !seen[day] {
+				seen[day] = true
+				days = append(days, day)
+			}
+		}
+	}
+	sort.Strings(days)
+	return days
+}
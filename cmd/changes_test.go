@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// changeTypes returns the type of each change, in order
+func changeTypes(changes []change) []changeType {
+	var types []changeType
+	for _, c := range changes {
+		types = append(types, c.Type)
+	}
+	return types
+}
+
+func TestDetectChanges(t *testing.T) {
+
+	now := time.Date(2019, time.September, 1, 12, 0, 0, 0, leagueLocation)
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+
+	tests := []struct {
+		name   string
+		before []game
+		after  []game
+		want   []changeType
+	}{
+		{
+			name:  "added",
+			after: []game{testGame(kickoff, "4150", "4153")},
+			want:  []changeType{changeAdded},
+		},
+		{
+			name:   "removed",
+			before: []game{testGame(kickoff, "4150", "4153")},
+			want:   []changeType{changeRemoved},
+		},
+		{
+			name:   "played games are not removed",
+			before: []game{testGame(now.AddDate(0, 0, -1), "4150", "4153")},
+		},
+		{
+			name:   "unchanged",
+			before: []game{testGame(kickoff, "4150", "4153")},
+			after:  []game{testGame(kickoff, "4150", "4153")},
+		},
+		{
+			name:   "moved to another day",
+			before: []game{testGame(kickoff, "4150", "4153")},
+			after:  []game{testGame(kickoff.AddDate(0, 0, 2), "4150", "4153")},
+			want:   []changeType{changeTimeMoved},
+		},
+		{
+			name:   "opponent changed",
+			before: []game{testGame(kickoff, "4150", "4153")},
+			after:  []game{testGame(kickoff, "4152", "4153")},
+			want:   []changeType{changeOpponentChanged},
+		},
+		{
+			name:   "home and away swapped",
+			before: []game{testGame(kickoff, "4150", "4153")},
+			after:  []game{testGame(kickoff, "4153", "4150")},
+			want:   []changeType{changeHomeAwaySwapped},
+		},
+		{
+			name:   "opponent changed and now away",
+			before: []game{testGame(kickoff, "4150", "4153")},
+			after:  []game{testGame(kickoff, "4153", "4152")},
+			want:   []changeType{changeOpponentChanged, changeHomeAwaySwapped},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assignGameKeys(nil, tt.before, now)
+			assignGameKeys(tt.before, tt.after, now)
+			got := changeTypes(detectChanges("4153", tt.before, tt.after, now))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareGamesLocationAndScore(t *testing.T) {
+
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	before := testGame(kickoff, "4150", "4153")
+	after := before
+	after.Location = "Burnaby 8 Rinks"
+	after.VisitingScore, after.HomeScore = "1", "3"
+
+	changes := compareGames("4153", before, after)
+	if len(changes) != 2 || changes[0].Type != changeLocationChanged || changes[1].Type != changeScorePosted {
+		t.Fatalf("got %v, want location_changed and score_posted", changeTypes(changes))
+	}
+	if changes[1].AfterValue != "Degenerates FC 1 - 3 Megpies FC" {
+		t.Errorf("score %q", changes[1].AfterValue)
+	}
+}
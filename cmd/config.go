@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configEnv names the environment variable holding the path of the config file
+	configEnv = "EIGHTRINKS_CONFIG"
+	// defaultTimeZone is the time zone the facility publishes its schedule in
+	defaultTimeZone = "America/Vancouver"
+)
+
+// configEnvOverrides are the environment variables that override settings of
+// the config file, for containers and CI where editing it is awkward
+var configEnvOverrides = map[string]func(c *config, value string){
+	"EIGHTRINKS_FACILITY_URL": func(c *config, value string) { c.FacilityURL = value },
+	"EIGHTRINKS_TIME_ZONE":    func(c *config, value string) { c.TimeZone = value },
+	"EIGHTRINKS_DB":           func(c *config, value string) { c.Database = value },
+}
+
+// config is the config file. It describes the facility, the teams to follow and
+// where their schedules go, either for everyone or for each profile. Every
+// setting is optional, the flags of the commands are used for anything it leaves
+// out, and flags given on the command line win.
+type config struct {
+	FacilityURL   string             `yaml:"facility_url"`
+	TimeZone      string             `yaml:"time_zone"`
+	Database      string             `yaml:"database"`
+	Teams         []teamConfig       `yaml:"teams"`
+	Sinks         []sinkConfig       `yaml:"sinks"`
+	Profiles      []profileConfig    `yaml:"profiles"`
+	Schedule      scheduleConfig     `yaml:"schedule"`
+	Notifications notificationConfig `yaml:"notifications"`
+
+	path     string // empty if there is no config file
+	location *time.Location
+}
+
+// teamConfig is a team to follow, by name or ID
+type teamConfig struct {
+	Name     string `yaml:"name"`
+	ID       string `yaml:"id"`
+	Division string `yaml:"division"`
+	Schedule string `yaml:"schedule"` // overrides the default schedule of the daemon
+}
+
+// profileConfig is someone following teams in calendars of their own, signed in
+// to with tokens of their own
+type profileConfig struct {
+	Name            string       `yaml:"name"`
+	Tokens          string       `yaml:"tokens"` // directory of the profile's tokens
+	TokenPassphrase secretRef    `yaml:"token_passphrase"`
+	Teams           []teamConfig `yaml:"teams"`
+	Sinks           []sinkConfig `yaml:"sinks"`
+}
+
+// sinkConfig is a calendar the schedules are synced to, with the same settings
+// as the sink flags
+type sinkConfig struct {
+	Type string `yaml:"type"` // google, graph, caldav, ics or stdout
+
+	File string `yaml:"file"` // ics
+
+	URL      string    `yaml:"url"` // caldav
+	Username string    `yaml:"username"`
+	Password secretRef `yaml:"password"`
+	Auth     string    `yaml:"auth"` // basic, digest or auto for caldav, oauth, service-account or auto for google
+
+	Calendar     string   `yaml:"calendar"` // google or graph
+	TeamCalendar bool     `yaml:"team_calendar"`
+	Share        []string `yaml:"share"`
+	Credentials  string   `yaml:"credentials"`
+	Impersonate  string   `yaml:"impersonate"`
+	AuthFlow     string   `yaml:"auth_flow"` // browser or auto
+	Token        string   `yaml:"token"`
+
+	ClientID string `yaml:"client_id"` // graph
+	Tenant   string `yaml:"tenant"`
+	GraphURL string `yaml:"graph_url"`
+}
+
+// scheduleConfig is when the daemon scrapes
+type scheduleConfig struct {
+	Default    string        `yaml:"default"`
+	Jitter     time.Duration `yaml:"jitter"`
+	PollBefore time.Duration `yaml:"poll_before"`
+	PollAfter  time.Duration `yaml:"poll_after"`
+	PollFast   time.Duration `yaml:"poll_fast"`
+	PollSlow   time.Duration `yaml:"poll_slow"`
+}
+
+// notificationConfig is who is told about schedule changes
+type notificationConfig struct {
+	Webhooks        []secretRef `yaml:"webhooks"`
+	WebhookTemplate string      `yaml:"webhook_template"`
+	DeadLetter      string      `yaml:"dead_letter"`
+	Email           emailConfig `yaml:"email"`
+}
+
+// emailConfig is where the digest is sent
+type emailConfig struct {
+	SMTP     string    `yaml:"smtp"`
+	Username string    `yaml:"username"`
+	Password secretRef `yaml:"password"`
+	From     string    `yaml:"from"`
+	To       []string  `yaml:"to"`
+}
+
+// secretRef is a setting that may be secret. It is either env:NAME to read it
+// from an environment variable, file:PATH to read it from a file, or the value
+// itself, which is best kept to things that aren't secret.
+type secretRef string
+
+// resolve returns the value the reference refers to
+func (r secretRef) resolve() (string, error) {
+	s := string(r)
+	switch {
+	case strings.HasPrefix(s, "env:"):
+		name := strings.TrimPrefix(s, "env:")
+		value := os.Getenv(name)
+		if value == "" {
+			return "", fmt.Errorf("the environment variable %s is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(s, "file:"):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(s, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return s, nil
+}
+
+// defaultConfigPath is where the config file is looked for when neither -config
+// nor the environment gives one
+func defaultConfigPath() string {
+	dir, err := configDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "config.yaml")
+}
+
+// useConfig loads the config file at path, or the one the environment names, or
+// the default one if there is one, applies the environment overrides, validates
+// it and applies the facility and time zone it gives. Without a config file the
+// environment overrides still apply.
+func useConfig(path string) (*config, error) {
+
+	explicit := path != ""
+	if path == "" {
+		path = os.Getenv(configEnv)
+		explicit = path != ""
+	}
+	if path == "" {
+		path = defaultConfigPath()
+	}
+
+	c := &config{}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := c.parse(b); err != nil {
+			return nil, fmt.Errorf("invalid config %s, %v", path, err)
+		}
+		c.path = path
+		log.Debugf("useConfig: using %s", path)
+	case !os.IsNotExist(err) || explicit:
+		return nil, fmt.Errorf("error reading config, %v", err)
+	}
+
+	for name, override := range configEnvOverrides {
+		if value := os.Getenv(name); value != "" {
+			override(c, value)
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.FacilityURL != "" {
+		schedulePageURL = c.FacilityURL
+	}
+	if c.location != nil {
+		leagueLocation = c.location
+	}
+	return c, nil
+}
+
+// parse decodes the config file, rejecting settings it doesn't know so typos
+// aren't silently ignored
+func (c *config) parse(b []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// validate checks every setting, reporting all the problems at once
+func (c *config) validate() error {
+
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.FacilityURL != "" {
+		u, err := url.Parse(c.FacilityURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			add("facility_url: %q is not an http or https URL of the schedule page", c.FacilityURL)
+		}
+	}
+	if c.TimeZone != "" {
+		loc, err := time.LoadLocation(c.TimeZone)
+		if err != nil {
+			add("time_zone: unknown time zone %q, expected a name like %s", c.TimeZone, defaultTimeZone)
+		}
+		c.location = loc
+	}
+
+	// A team followed in several places is scraped once, on one schedule
+	schedules := make(map[string]string)
+	checkTeams := func(prefix string, teams []teamConfig) {
+		seen := make(map[string]bool)
+		for i, t := range teams {
+			field := fmt.Sprintf("%steams[%d]", prefix, i)
+			if t.Name == "" && t.ID == "" {
+				add("%s: give the team a name or an id", field)
+				continue
+			}
+			ref := t.ref()
+			if seen[ref.key()] {
+				add("%s: %s is listed more than once", field, ref)
+			}
+			seen[ref.key()] = true
+			if t.Schedule == "" {
+				continue
+			}
+			if t.Schedule != "adaptive" {
+				if _, err := parseSchedule(t.Schedule); err != nil {
+					add("%s.schedule: %v", field, err)
+				}
+			}
+			if other, ok := schedules[ref.key()]; ok && other != t.Schedule {
+				add("%s.schedule: %s is scraped %q elsewhere, a team has one schedule", field, ref, other)
+			}
+			schedules[ref.key()] = t.Schedule
+		}
+	}
+	checkSinks := func(prefix string, sinks []sinkConfig) {
+		for i, sc := range sinks {
+			for _, problem := range sc.problems() {
+				add("%ssinks[%d]: %s", prefix, i, problem)
+			}
+		}
+	}
+	checkTeams("", c.Teams)
+	checkSinks("", c.Sinks)
+
+	names := make(map[string]bool)
+	for i, p := range c.Profiles {
+		prefix := fmt.Sprintf("profiles[%d].", i)
+		switch {
+		case p.Name == "":
+			add("%sname: every profile needs a name", prefix)
+		case strings.ContainsAny(p.Name, `/\`) || p.Name == "." || p.Name == "..":
+			add("%sname: %q can't be used as a directory name", prefix, p.Name)
+		case p.Name == defaultProfile:
+			add("%sname: %s is the profile of the teams and sinks at the top of the file", prefix, defaultProfile)
+		case names[p.Name]:
+			add("%sname: there is already a profile called %s", prefix, p.Name)
+		}
+		names[p.Name] = true
+		if len(p.Teams) == 0 {
+			add("%steams: profile %s follows no teams", prefix, p.Name)
+		}
+		if p.TokenPassphrase != "" {
+			if _, err := p.TokenPassphrase.resolve(); err != nil {
+				add("%stoken_passphrase: %v", prefix, err)
+			}
+		}
+		checkTeams(prefix, p.Teams)
+		checkSinks(prefix, p.Sinks)
+	}
+
+	s := c.Schedule
+	if s.Default != "" && s.Default != "adaptive" {
+		if _, err := parseSchedule(s.Default); err != nil {
+			add("schedule.default: %v", err)
+		}
+	}
+	if s.Jitter < 0 {
+		add("schedule.jitter: can't be negative")
+	}
+	if s.PollBefore < 0 || s.PollAfter < 0 || s.PollFast < 0 || s.PollSlow < 0 {
+		add("schedule: the poll windows and intervals can't be negative")
+	}
+
+	n := c.Notifications
+	for i, ref := range n.Webhooks {
+		field := fmt.Sprintf("notifications.webhooks[%d]", i)
+		value, err := ref.resolve()
+		if err != nil {
+			add("%s: %v", field, err)
+			continue
+		}
+		if u, err := url.Parse(value); err != nil || u.Host == "" {
+			// The URL itself may be secret, so it isn't repeated
+			add("%s: not a URL", field)
+		}
+	}
+	if n.Email.Password != "" {
+		if _, err := n.Email.Password.resolve(); err != nil {
+			add("notifications.email.password: %v", err)
+		}
+	}
+	if len(n.Email.To) > 0 && n.Email.From == "" {
+		add("notifications.email: from is needed to send to %s", strings.Join(n.Email.To, ", "))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	where := "environment"
+	if c.path != "" {
+		where = c.path
+	}
+	return fmt.Errorf("invalid config %s:\n  %s", where, strings.Join(problems, "\n  "))
+}
+
+// problems returns what is wrong with the sink settings
+func (sc sinkConfig) problems() []string {
+
+	var problems []string
+	switch sc.Type {
+	case "google", "graph", "ics", "stdout":
+	case "caldav":
+		if sc.URL == "" {
+			problems = append(problems, "the caldav sink needs the url of the calendar collection")
+		}
+	case "":
+		return []string{"type is missing, expected google, graph, caldav, ics or stdout"}
+	default:
+		return []string{fmt.Sprintf("unknown type %s, expected google, graph, caldav, ics or stdout", sc.Type)}
+	}
+	if sc.Type == "graph" && sc.ClientID == "" {
+		problems = append(problems, "the graph sink needs the client_id of an Azure AD app registration")
+	}
+	if len(sc.Share) > 0 && !sc.TeamCalendar {
+		problems = append(problems, "share needs team_calendar, other calendars are never shared")
+	}
+	if sc.Password != "" {
+		if _, err := sc.Password.resolve(); err != nil {
+			problems = append(problems, "password: "+err.Error())
+		}
+	}
+	return problems
+}
+
+// options returns the sink options the settings stand for, with the defaults of
+// the sink flags for anything left out
+func (sc sinkConfig) options() (sinkOptions, error) {
+
+	o := sinkOptions{
+		Sink:           sc.Type,
+		ICSFile:        sc.File,
+		CalDAVURL:      sc.URL,
+		CalDAVUser:     sc.Username,
+		CalDAVAuth:     "auto",
+		GoogleCalendar: "primary",
+		TeamCalendar:   sc.TeamCalendar,
+		Share:          stringList(sc.Share),
+		GoogleToken:    sc.Token,
+		MSClientID:     sc.ClientID,
+		MSTenant:       "common",
+		MSCalendar:     sc.Calendar,
+		MSToken:        sc.Token,
+		GraphURL:       graphURL,
+	}
+	o.GoogleAuth = googleAuth{Method: "auto", Credentials: sc.Credentials, Impersonate: sc.Impersonate, Flow: "auto"}
+	if sc.Type == "google" && sc.Calendar != "" {
+		o.GoogleCalendar = sc.Calendar
+	}
+	if sc.Auth != "" {
+		o.CalDAVAuth, o.GoogleAuth.Method = sc.Auth, sc.Auth
+	}
+	if sc.AuthFlow != "" {
+		o.GoogleAuth.Flow = sc.AuthFlow
+	}
+	if sc.Tenant != "" {
+		o.MSTenant = sc.Tenant
+	}
+	if sc.GraphURL != "" {
+		o.GraphURL = sc.GraphURL
+	}
+	if sc.Password != "" {
+		var err error
+		if o.CalDAVPassword, err = sc.Password.resolve(); err != nil {
+			return o, err
+		}
+	}
+	return o, o.validate()
+}
+
+// ref returns the team as a reference to scrape it by
+func (t teamConfig) ref() teamRef {
+	return teamRef{Name: t.Name, ID: t.ID, Division: t.Division}
+}
+
+// sinkOptions returns the sinks of the config file
+func (c *config) sinkOptions() ([]sinkOptions, error) {
+	var sinks []sinkOptions
+	for i, sc := range c.Sinks {
+		o, err := sc.options()
+		if err != nil {
+			return nil, fmt.Errorf("sinks[%d]: %v", i, err)
+		}
+		sinks = append(sinks, o)
+	}
+	return sinks, nil
+}
+
+// applyFlags sets the flags of fs the config file has settings for, unless they
+// were given on the command line
+func (c *config) applyFlags(fs *flag.FlagSet) error {
+
+	set := func(name string, values ...string) error {
+		if flagGiven(fs, name) || fs.Lookup(name) == nil {
+			return nil
+		}
+		for _, value := range values {
+			if value == "" {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("error applying config to -%s, %v", name, err)
+			}
+		}
+		return nil
+	}
+	duration := func(d time.Duration) string {
+		if d == 0 {
+			return ""
+		}
+		return d.String()
+	}
+
+	n := c.Notifications
+	var webhooks []string
+	for _, ref := range n.Webhooks {
+		value, err := ref.resolve()
+		if err != nil {
+			return err
+		}
+		webhooks = append(webhooks, value)
+	}
+	for _, err := range []error{
+		set("db", c.Database),
+		set("schedule", c.Schedule.Default),
+		set("jitter", duration(c.Schedule.Jitter)),
+		set("poll-before", duration(c.Schedule.PollBefore)),
+		set("poll-after", duration(c.Schedule.PollAfter)),
+		set("poll-fast", duration(c.Schedule.PollFast)),
+		set("poll-slow", duration(c.Schedule.PollSlow)),
+		set("webhook", webhooks...),
+		set("webhook-template", n.WebhookTemplate),
+		set("dead-letter", n.DeadLetter),
+		set("smtp", n.Email.SMTP),
+		set("smtp-user", n.Email.Username),
+		set("from", n.Email.From),
+		set("to", n.Email.To...),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configure loads the config file for a command, see useConfig, and sets the
+// command's flags from it
+func configure(fs *flag.FlagSet, path string) (*config, error) {
+	c, err := useConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.applyFlags(fs)
+}
+
+// flagGiven reports whether the flag was given on the command line
+func flagGiven(fs *flag.FlagSet, name string) bool {
+	given := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// configUsage is the usage of the -config flag of every command
+const configUsage = "Path to the config file (default $" + configEnv + " or config.yaml in the user config directory, if there is one)"
+
+// configTemplate is the commented config file init writes
+const configTemplate = `# Config file of the 8 Rinks scraper. Every setting is optional, and flags
+# given on the command line override the settings here. Settings that may be
+# secret take env:NAME to read an environment variable or file:PATH to read a
+# file. The environment variables EIGHTRINKS_FACILITY_URL, EIGHTRINKS_TIME_ZONE
+# and EIGHTRINKS_DB override the settings of the same name.
+
+# The schedule page of the facility, and the time zone it publishes times in
+facility_url: ` + defaultSchedulePageURL + `
+time_zone: ` + defaultTimeZone + `
+
+# The SQLite database the schedules are stored in
+database: 8rinks.db
+
+# The teams to follow, by name or by the tid the site gives them. A division
+# (did) narrows the schedule to it, and a schedule overrides the daemon default.
+teams: []
+  # - name: Megpies FC
+  # - id: "4153"
+  #   division: "483"
+  #   schedule: adaptive
+
+# The calendars the schedules are synced to, by sync and the daemon. The types
+# and their settings are those of the -sink flags.
+sinks: []
+  # - type: ics
+  #   file: megpies.ics
+  # - type: google
+  #   team_calendar: true
+  #   share: [manager@example.com]
+  #   credentials: /path/to/client_secret.json
+  # - type: caldav
+  #   url: https://cloud.example.com/remote.php/dav/calendars/me/soccer/
+  #   username: me
+  #   password: env:EIGHTRINKS_CALDAV_PASSWORD
+  # - type: graph
+  #   client_id: 00000000-0000-0000-0000-000000000000
+
+# People following teams in calendars of their own. A profile has its own teams
+# and sinks, and signs in with tokens of its own, kept in tokens (default
+# profiles/<name> in the user config directory). A team followed by several
+# profiles is scraped once and synced to all their calendars. Sign a profile in
+# the first time with sync -profile <name>.
+profiles: []
+  # - name: alex
+  #   token_passphrase: env:ALEX_TOKEN_PASSPHRASE
+  #   teams:
+  #     - name: Megpies FC
+  #   sinks:
+  #     - type: google
+  #       team_calendar: true
+  #       credentials: /path/to/client_secret.json
+
+# When the daemon scrapes. The default is a cron expression in the league time
+# zone, @every <duration>, or adaptive to poll fast around games.
+schedule:
+  default: "@every 1h"
+  jitter: 5m
+  poll_before: 3h
+  poll_after: 2h
+  poll_fast: 15m
+  poll_slow: 6h
+
+# Who is told about schedule changes
+notifications:
+  webhooks: []
+  # - env:EIGHTRINKS_WEBHOOK_URL
+  dead_letter: webhooks.dead.jsonl
+  email:
+    smtp: localhost:25
+    # username: me
+    # password: env:SMTP_PASSWORD
+    # from: scraper@example.com
+    # to: [team@example.com]
+`
+
+// initCommand writes a commented config file to start from
+func initCommand(args []string) error {
+
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	var path = fs.String("config", "", "Path to write the config file to (default $"+configEnv+" or config.yaml in the user config directory)")
+	var force = fs.Bool("force", false, "Overwrite the config file if there already is one")
+	fs.Parse(args)
+
+	if *path == "" {
+		*path = os.Getenv(configEnv)
+	}
+	if *path == "" {
+		*path = defaultConfigPath()
+	}
+	if *path == "" {
+		return fmt.Errorf("no config path, give one with -config")
+	}
+	if _, err := os.Stat(*path); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", *path)
+	}
+	if err := writeFileAtomic(*path, []byte(configTemplate), 0600); err != nil {
+		return fmt.Errorf("error writing config, %v", err)
+	}
+	log.Infof("Wrote a config file to %s", *path)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restoreFacility puts back the facility and time zone a config applies
+func restoreFacility(t *testing.T) {
+	url, loc := schedulePageURL, leagueLocation
+	t.Cleanup(func() { schedulePageURL, leagueLocation = url, loc })
+}
+
+func TestConfigTemplate(t *testing.T) {
+
+	var c config
+	if err := c.parse([]byte(configTemplate)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// A config written by init and not yet edited changes nothing
+	if len(c.Teams) > 0 || len(c.Sinks) > 0 || len(c.Profiles) > 0 {
+		t.Errorf("the template follows teams %v with sinks %v and profiles %v", c.Teams, c.Sinks, c.Profiles)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+
+	tests := []struct {
+		yaml     string
+		problems []string
+	}{
+		{"time_zone: Asia/Kolkata\nteams: [{name: Megpies FC}, {id: \"4150\"}]\nsinks: [{type: ics, file: a.ics}]\n", nil},
+		{"facility_url: ftp://example.com/\n", []string{"facility_url"}},
+		{"time_zone: Mars/Olympus\n", []string{"time_zone"}},
+		{"teams: [{division: \"483\"}, {name: Megpies FC}, {name: Megpies FC}]\n", []string{"teams[0]: give the team a name", "teams[2]: Megpies FC is listed more than once"}},
+		{"teams: [{name: Megpies FC, schedule: \"61 * * * *\"}]\n", []string{"teams[0].schedule"}},
+		{"sinks: [{type: caldav}, {type: outlook}, {type: graph}, {type: ics, share: [a@example.com]}]\n", []string{
+			"sinks[0]: the caldav sink needs the url",
+			"sinks[1]: unknown type outlook",
+			"sinks[2]: the graph sink needs the client_id",
+			"sinks[3]: share needs team_calendar",
+		}},
+		{"profiles: [{name: default, teams: [{name: Megpies FC}]}, {name: alex}, {name: alex, teams: [{name: Megpies FC}]}]\n", []string{
+			"profiles[0].name: default is the profile",
+			"profiles[1].teams: profile alex follows no teams",
+			"profiles[2].name: there is already a profile called alex",
+		}},
+		{"teams: [{name: Megpies FC, schedule: \"@daily\"}]\nprofiles: [{name: alex, teams: [{name: Megpies FC, schedule: \"@hourly\"}]}]\n", []string{"a team has one schedule"}},
+		{"schedule: {jitter: -1m}\n", []string{"schedule.jitter"}},
+		{"notifications: {webhooks: [env:EIGHTRINKS_TEST_UNSET_WEBHOOK], email: {to: [a@example.com]}}\n", []string{
+			"notifications.webhooks[0]: the environment variable EIGHTRINKS_TEST_UNSET_WEBHOOK is not set",
+			"notifications.email: from is needed",
+		}},
+	}
+
+	for _, tt := range tests {
+		var c config
+		if err := c.parse([]byte(tt.yaml)); err != nil {
+			t.Errorf("%q: %v", tt.yaml, err)
+			continue
+		}
+		err := c.validate()
+		if len(tt.problems) == 0 {
+			if err != nil {
+				t.Errorf("%q: %v", tt.yaml, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%q: valid, want %v", tt.yaml, tt.problems)
+			continue
+		}
+		// Every problem is reported at once
+		for _, problem := range tt.problems {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("%q: %v doesn't report %q", tt.yaml, err, problem)
+			}
+		}
+	}
+
+	var c config
+	if err := c.parse([]byte("team: [{name: Megpies FC}]\n")); err == nil {
+		t.Errorf("parsed a config with a misspelt setting")
+	}
+}
+
+func TestApplyFlagsPrecedence(t *testing.T) {
+
+	var c config
+	err := c.parse([]byte("database: config.db\nschedule: {default: \"@daily\", jitter: 1m}\nnotifications: {email: {to: [a@example.com, b@example.com]}}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	db := fs.String("db", "8rinks.db", "")
+	schedule := fs.String("schedule", "@every 1h", "")
+	jitter := fs.Duration("jitter", 5*time.Minute, "")
+	deadLetter := fs.String("dead-letter", "webhooks.dead.jsonl", "")
+	var to stringList
+	fs.Var(&to, "to", "")
+	if err := fs.Parse([]string{"-db", "flag.db"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.applyFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags given on the command line win, then the config, then the defaults
+	if *db != "flag.db" {
+		t.Errorf("-db is %s, want the flag given", *db)
+	}
+	if *schedule != "@daily" || *jitter != time.Minute || strings.Join(to, ",") != "a@example.com,b@example.com" {
+		t.Errorf("-schedule %s, -jitter %v and -to %v aren't the config's", *schedule, *jitter, to)
+	}
+	if *deadLetter != "webhooks.dead.jsonl" {
+		t.Errorf("-dead-letter is %s, want the default", *deadLetter)
+	}
+}
+
+func TestUseConfigEnvOverrides(t *testing.T) {
+
+	restoreFacility(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("facility_url: https://example.com/schedule.aspx\ntime_zone: America/Toronto\ndatabase: config.db\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configEnv, path)
+	t.Setenv("EIGHTRINKS_TIME_ZONE", "Asia/Kolkata")
+	t.Setenv("EIGHTRINKS_DB", "env.db")
+	t.Setenv("EIGHTRINKS_FACILITY_URL", "")
+
+	c, err := useConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Database != "env.db" || c.TimeZone != "Asia/Kolkata" {
+		t.Errorf("got database %s and time zone %s, want the environment's", c.Database, c.TimeZone)
+	}
+	if leagueLocation.String() != "Asia/Kolkata" || schedulePageURL != "https://example.com/schedule.aspx" {
+		t.Errorf("using %s in %s, want the file's facility in the environment's time zone", schedulePageURL, leagueLocation)
+	}
+
+	// An override is validated like the file
+	t.Setenv("EIGHTRINKS_TIME_ZONE", "Mars/Olympus")
+	if _, err := useConfig(""); err == nil || !strings.Contains(err.Error(), "time_zone") {
+		t.Errorf("got %v, want the time zone of the environment rejected", err)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// daemonTeam is a team the daemon scrapes, when, and the calendars it is synced
+// to afterwards
+type daemonTeam struct {
+	Team     teamRef
+	Schedule schedule
+	Syncs    []profileSink
+}
+
+// daemon scrapes each team on its schedule, notifies the webhooks of changes and
+// syncs the team's calendar. Runs never overlap, so the site sees one request at
+// a time and the store one writer.
+type daemon struct {
+	store    *Store
+	notifier *webhookNotifier
+	jitter   time.Duration
+
+	mu sync.Mutex // held for the duration of a run
+}
+
+// daemonCommand keeps running, scraping and syncing teams on their schedules until
+// it is sent SIGTERM or interrupted. Runs in progress are allowed to finish. The
+// teams and sinks of the config file are used unless -team or -sink are given,
+// each team scraped once for all the profiles following it.
+func daemonCommand(args []string) error {
+
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	var configPath = fs.String("config", "", configUsage)
+	var dbPath = fs.String("db", "8rinks.db", "Path to the SQLite database the schedule is stored in")
+	var teamSpecs stringList
+	fs.Var(&teamSpecs, "team", "Team to scrape, as name or name=schedule to override -schedule, may be repeated (default Megpies FC)")
+	var defaultSchedule = fs.String("schedule", "@every 1h", "When teams are scraped, a cron expression in the league time zone, @every <duration>, or adaptive to poll around games")
+	var windows pollWindows
+	fs.DurationVar(&windows.Before, "poll-before", 3*time.Hour, "With the adaptive schedule, how long before kickoff polling speeds up")
+	fs.DurationVar(&windows.After, "poll-after", 2*time.Hour, "With the adaptive schedule, how long after a game ends polling stays fast")
+	fs.DurationVar(&windows.Fast, "poll-fast", 15*time.Minute, "With the adaptive schedule, how often teams are polled around their games")
+	fs.DurationVar(&windows.Slow, "poll-slow", 6*time.Hour, "With the adaptive schedule, how often teams are polled the rest of the time")
+	var jitter = fs.Duration("jitter", 5*time.Minute, "Up to how long each run is randomly delayed, so runs don't all hit the site at once")
+	var grace = fs.Duration("shutdown-grace", time.Minute, "How long runs in progress have to finish once the daemon is told to stop")
+	var runAtStart = fs.Bool("run-at-start", true, "Scrape every team when the daemon starts, before following the schedules")
+	var lockPath = fs.String("lock", "", "Path of the lock file that keeps a second daemon from running (default the database path with .lock)")
+	var webhooks stringList
+	fs.Var(&webhooks, "webhook", "URL to post schedule changes to, may be repeated")
+	var webhookTemplate = fs.String("webhook-template", "", "Path to a text/template file the webhook payload is rendered from")
+	var deadLetter = fs.String("dead-letter", "webhooks.dead.jsonl", "Path of the log webhook posts that could not be delivered are appended to")
+	var d daemon
+	var sinkFlags sinkOptions
+	sinkFlags.register(fs, "")
+	var site siteFlags
+	site.register(fs)
+	fs.Parse(args)
+
+	cfg, err := configure(fs, *configPath)
+	if err != nil {
+		return err
+	}
+	if err := site.apply(); err != nil {
+		return err
+	}
+
+	var flagSinks []sinkOptions
+	if sinkFlags.Sink != "" {
+		flagSinks = []sinkOptions{sinkFlags}
+	}
+	// The teams of the config file each have the sinks of the profiles following
+	// them, teams given with -team all have the same sinks
+	var followed []followedTeam
+	var specSyncs []profileSink
+	if len(teamSpecs) == 0 && len(cfg.teamRefs()) > 0 {
+		profiles, err := cfg.profiles(flagSinks, sinkFlags.Sink != "")
+		if err != nil {
+			return err
+		}
+		followed = followedTeams(profiles)
+	} else {
+		if len(teamSpecs) == 0 {
+			teamSpecs = stringList{"Megpies FC"}
+		}
+		sinks := flagSinks
+		if sinks == nil {
+			if sinks, err = cfg.sinkOptions(); err != nil {
+				return err
+			}
+		}
+		for _, o := range sinks {
+			if err := o.validate(); err != nil {
+				return err
+			}
+			specSyncs = append(specSyncs, profileSink{Sink: o})
+		}
+	}
+	if *jitter < 0 {
+		return fmt.Errorf("-jitter can't be negative")
+	}
+	d.jitter = *jitter
+
+	if *lockPath == "" {
+		*lockPath = *dbPath + ".lock"
+	}
+	release, err := acquireLock(*lockPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if len(webhooks) > 0 {
+		d.notifier, err = newWebhookNotifier(webhooks, *webhookTemplate, *deadLetter)
+		if err != nil {
+			return err
+		}
+	}
+	d.store, err = OpenStore(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer d.store.Close()
+
+	adaptive := func(team teamRef) (schedule, error) {
+		return newAdaptiveSchedule(d.store, team, windows)
+	}
+	var teams []daemonTeam
+	if followed != nil {
+		for _, f := range followed {
+			sched := f.Schedule
+			if sched == "" {
+				sched = *defaultSchedule
+			}
+			t, err := newDaemonTeam(f.Team, sched, adaptive)
+			if err != nil {
+				return err
+			}
+			t.Syncs = f.Syncs
+			teams = append(teams, t)
+		}
+	} else {
+		if teams, err = parseDaemonTeams(teamSpecs, *defaultSchedule, adaptive); err != nil {
+			return err
+		}
+		for i := range teams {
+			teams[i].Syncs = specSyncs
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	// Runs outlive the signal by the grace period, so they can finish cleanly
+	runCtx, cancelRuns := context.WithCancel(context.Background())
+	defer cancelRuns()
+
+	var wg sync.WaitGroup
+	for _, t := range teams {
+		wg.Add(1)
+		go func(t daemonTeam) {
+			defer wg.Done()
+			d.loop(ctx, runCtx, t, *runAtStart)
+		}(t)
+	}
+	log.Infof("Daemon started for %d teams", len(teams))
+
+	<-ctx.Done()
+	log.Infof("Daemon stopping, waiting up to %v for runs in progress", *grace)
+	timer := time.AfterFunc(*grace, cancelRuns)
+	defer timer.Stop()
+	wg.Wait()
+	return nil
+}
+
+// parseDaemonTeams parses the -team flags, each a name optionally followed by
+// = and the team's schedule. The adaptive schedule of a team comes from adaptive.
+func parseDaemonTeams(specs []string, defaultSchedule string, adaptive func(team teamRef) (schedule, error)) ([]daemonTeam, error) {
+
+	var teams []daemonTeam
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		name, sched := spec, defaultSchedule
+		if i := strings.Index(spec, "="); i >= 0 {
+			name, sched = strings.TrimSpace(spec[:i]), spec[i+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid team %q, the name is missing", spec)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("team %s is given more than once", name)
+		}
+		seen[name] = true
+		t, err := newDaemonTeam(teamRef{Name: name}, sched, adaptive)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	return teams, nil
+}
+
+// newDaemonTeam returns the team with its schedule parsed
+func newDaemonTeam(team teamRef, sched string, adaptive func(team teamRef) (schedule, error)) (daemonTeam, error) {
+	var s schedule
+	var err error
+	if strings.TrimSpace(sched) == "adaptive" {
+		s, err = adaptive(team)
+	} else {
+		s, err = parseSchedule(sched)
+	}
+	if err != nil {
+		return daemonTeam{}, fmt.Errorf("team %s: %v", team, err)
+	}
+	return daemonTeam{Team: team, Schedule: s}, nil
+}
+
+// loop runs the team on its schedule until ctx is done. Runs are given runCtx, so
+// a run that has started isn't cut short with ctx.
+func (d *daemon) loop(ctx context.Context, runCtx context.Context, t daemonTeam, runNow bool) {
+
+	for {
+		wait := time.Duration(0)
+		if !runNow {
+			now := time.Now()
+			next := t.Schedule.Next(now)
+			if next.IsZero() {
+				log.Errorf("loop: the schedule of %s never runs", t.Team)
+				return
+			}
+			wait = next.Sub(now)
+			if d.jitter > 0 {
+				wait += time.Duration(rand.Int63n(int64(d.jitter)))
+			}
+			log.Debugf("loop: next run of %s in %v", t.Team, wait.Round(time.Second))
+		}
+		runNow = false
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		d.run(ctx, runCtx, t)
+	}
+}
+
+// run scrapes the team, notifies the webhooks of any changes and syncs the
+// calendars of every profile following the team. Failures are logged and
+// recorded against the run, the next run tries again. A run still waiting for
+// another to finish when stop is done doesn't start.
+func (d *daemon) run(stop context.Context, ctx context.Context, t daemonTeam) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if stop.Err() != nil {
+		log.Infof("run: not scraping %s, the daemon is stopping", t.Team)
+		return
+	}
+
+	result, changes, err := scrapeAndSave(ctx, d.store, t.Team)
+	if err != nil {
+		log.Errorf("run: error scraping %s, %v", t.Team, err)
+		return
+	}
+	log.Infof("run: scraped %d games and %d changes for %s", len(result.Games), len(changes), result.TeamName)
+
+	if d.notifier != nil && len(changes) > 0 {
+		err := d.notifier.Notify(notification{
+			TeamID:   result.TeamID,
+			TeamName: result.TeamName,
+			Changes:  changes,
+			Games:    result.Games,
+		})
+		if err != nil {
+			log.Errorf("run: %v", err)
+		}
+	}
+
+	if len(t.Syncs) == 0 {
+		return
+	}
+	// The run records the sync to every sink, failed if any of them failed. A
+	// profile failing to sync doesn't keep the others from syncing.
+	var synced syncPlan
+	var failures []string
+	for _, s := range t.Syncs {
+		sink := s.Sink.Sink
+		if s.Profile != "" {
+			sink = s.Profile + " " + sink
+		}
+		plan, err := syncTeam(ctx, d.store, s.Sink, result, false)
+		if err != nil {
+			log.Errorf("run: error syncing %s to %s, %v", result.TeamName, sink, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", sink, err))
+		}
+		synced.Actions = append(synced.Actions, plan.Actions...)
+	}
+	var syncErr error
+	if len(failures) > 0 {
+		syncErr = fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	if err := d.store.RecordSync(result.RunID, synced, syncErr); err != nil {
+		log.Errorf("run: %v", err)
+	}
+}
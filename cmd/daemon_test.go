@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRunWaitingWhenStoppedDoesNotScrape(t *testing.T) {
+
+	transport := siteClient.Client.Transport
+	defer func() { siteClient.Client.Transport = transport }()
+	requests := 0
+	siteClient.Client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests++
+		return nil, fmt.Errorf("the site was asked for %s", r.URL)
+	})
+
+	d := &daemon{store: openTestStore(t)}
+	stop, cancel := context.WithCancel(context.Background())
+
+	// Another run holds the lock when the daemon is told to stop
+	d.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		d.run(stop, context.Background(), daemonTeam{Team: teamRef{Name: "Megpies FC"}})
+		close(done)
+	}()
+	cancel()
+	d.mu.Unlock()
+	<-done
+
+	if requests != 0 {
+		t.Errorf("the waiting run scraped, sending %d requests", requests)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const digestTextTemplate = `Games from {{ .From }} to {{ .To }}
+{{ range .Teams }}
+{{ .Name }}
+{{ range .Games }}  {{ .Kickoff }}  {{ .HomeAway }} vs {{ .Opponent }} at {{ .Location }}
+{{ else }}  No games
+{{ end }}{{ if .Changes }}
+  Schedule changes since the last digest:
+{{ range .Changes }}  - {{ . }}
+{{ end }}{{ end }}{{ end }}`
+
+const digestHTMLTemplate = `<html>
+<body style="font-family: sans-serif;">
+<h2>Games from {{ .From }} to {{ .To }}</h2>
+{{ range .Teams }}
+<h3>{{ .Name }}</h3>
+{{ if .Games }}
+<table cellpadding="4" style="border-collapse: collapse;">
+<tr><th align="left">Kickoff</th><th align="left"></th><th align="left">Opponent</th><th align="left">Location</th></tr>
+{{ range .Games }}<tr><td>{{ .Kickoff }}</td><td>{{ .HomeAway }}</td><td>{{ .Opponent }}</td><td>{{ .Location }}</td></tr>
+{{ end }}</table>
+{{ else }}
+<p>No games</p>
+{{ end }}
+{{ if .Changes }}
+<p>Schedule changes since the last digest:</p>
+<ul>
+{{ range .Changes }}<li>{{ . }}</li>
+{{ end }}</ul>
+{{ end }}
+{{ end }}
+</body>
+</html>
+`
+
+// digest is the data the digest templates are rendered against
+type digest struct {
+	From  string
+	To    string
+	Teams []digestTeam
+}
+
+type digestTeam struct {
+	ID      string
+	Name    string
+	Games   []digestGame
+	Changes []string
+}
+
+type digestGame struct {
+	Kickoff  string
+	HomeAway string
+	Opponent string
+	Location string
+}
+
+// smtpConfig is where and how digests are sent
+type smtpConfig struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// digestCommand emails the upcoming games of each team, along with the changes to
+// their schedules since the last digest. The schedule is read from the store, so
+// it is only as fresh as the last scrape. Without -tn the digest covers the teams
+// of the config file, and is sent as its email settings say.
+func digestCommand(args []string) error {
+
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	var configPath = fs.String("config", "", configUsage)
+	var teamNames stringList
+	fs.Var(&teamNames, "tn", "Team name to include in the digest, may be repeated (default Megpies FC)")
+	var dbPath = fs.String("db", "8rinks.db", "Path to the SQLite database the schedule is stored in")
+	var days = fs.Int("days", 7, "Number of days of games to include")
+	var cfg smtpConfig
+	var to stringList
+	fs.StringVar(&cfg.Addr, "smtp", "localhost:25", "Address of the SMTP server, host:port")
+	fs.StringVar(&cfg.Username, "smtp-user", "", "SMTP username, the password is read from SMTP_PASSWORD")
+	fs.StringVar(&cfg.From, "from", "", "Address the digest is sent from")
+	fs.Var(&to, "to", "Address to send the digest to, may be repeated")
+	var dryRun = fs.Bool("dry-run", false, "Print the digest instead of sending it")
+	fs.Parse(args)
+
+	conf, err := configure(fs, *configPath)
+	if err != nil {
+		return err
+	}
+	var teams []teamRef
+	for _, name := range teamNames {
+		teams = append(teams, teamRef{Name: name})
+	}
+	if len(teams) == 0 {
+		teams = conf.teamRefs()
+	}
+	if len(teams) == 0 {
+		teams = []teamRef{{Name: "Megpies FC"}}
+	}
+	cfg.To = to
+	cfg.Password = os.Getenv("SMTP_PASSWORD")
+	if cfg.Password == "" && conf.Notifications.Email.Password != "" {
+		if cfg.Password, err = conf.Notifications.Email.Password.resolve(); err != nil {
+			return err
+		}
+	}
+	if !*dryRun && (cfg.From == "" || len(cfg.To) == 0) {
+		return fmt.Errorf("digest needs -from and at least one -to")
+	}
+
+	store, err := OpenStore(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	now := time.Now()
+	d, err := buildDigest(store, teams, now, *days)
+	if err != nil {
+		return err
+	}
+
+	text, html, err := renderDigest(d)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Println(text)
+		return nil
+	}
+
+	subject := fmt.Sprintf("Games from %s to %s", d.From, d.To)
+	if err := sendDigest(cfg, subject, text, html); err != nil {
+		return err
+	}
+	log.Infof("Sent digest to %s", strings.Join(cfg.To, ", "))
+
+	for _, t := range d.Teams {
+		if err := store.RecordDigest(t.ID, cfg.To, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildDigest collects the games of the next days for each team, and the changes
+// since the team's last digest, or since as many days ago if there hasn't been one
+func buildDigest(store *Store, teams []teamRef, now time.Time, days int) (digest, error) {
+
+	local := now.In(leagueLocation)
+	from := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, leagueLocation)
+	to := from.AddDate(0, 0, days)
+	d := digest{
+		From: from.Format("Mon Jan 2"),
+		To:   to.AddDate(0, 0, -1).Format("Mon Jan 2"),
+	}
+
+	for _, ref := range teams {
+		t, err := store.TeamByRef(ref)
+		if err != nil {
+			return d, err
+		}
+		dt := digestTeam{ID: t.ID, Name: t.Name}
+
+		games, err := store.UpcomingGames(t.ID, now, to)
+		if err != nil {
+			return d, err
+		}
+		for _, g := range games {
+			dt.Games = append(dt.Games, digestGame{
+				Kickoff:  g.StartTime.In(leagueLocation).Format("Mon Jan 2, 3:04 PM"),
+				HomeAway: g.homeAway(t.ID),
+				Opponent: g.opponent(t.ID),
+				Location: g.Location,
+			})
+		}
+
+		since, err := store.LastDigest(t.ID)
+		if err != nil {
+			return d, err
+		}
+		if since.IsZero() {
+			since = now.AddDate(0, 0, -days)
+		}
+		changes, err := store.Changes(t.ID, since)
+		if err != nil {
+			return d, err
+		}
+		for _, c := range changes {
+			dt.Changes = append(dt.Changes, c.String())
+		}
+
+		d.Teams = append(d.Teams, dt)
+	}
+	return d, nil
+}
+
+// renderDigest renders the plain text and HTML bodies of the digest
+func renderDigest(d digest) (text string, html string, err error) {
+
+	var textBuf, htmlBuf bytes.Buffer
+	textTmpl := template.Must(template.New("digest").Parse(digestTextTemplate))
+	if err := textTmpl.Execute(&textBuf, d); err != nil {
+		return "", "", fmt.Errorf("error rendering digest, %v", err)
+	}
+	htmlTmpl := htmltemplate.Must(htmltemplate.New("digest").Parse(digestHTMLTemplate))
+	if err := htmlTmpl.Execute(&htmlBuf, d); err != nil {
+		return "", "", fmt.Errorf("error rendering digest, %v", err)
+	}
+	return textBuf.String(), htmlBuf.String(), nil
+}
+
+// writeDigestBody writes the plain text and HTML bodies as the parts of a
+// multipart/alternative body and returns its boundary. Closing the writers
+// writes the end of each part, so an error there means the body is cut short.
+func writeDigestBody(w io.Writer, text string, html string) (string, error) {
+
+	mw := multipart.NewWriter(w)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.content)); err != nil {
+			return "", err
+		}
+		if err := qw.Close(); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return mw.Boundary(), nil
+}
+
+// sendDigest sends a multipart/alternative email with the plain text and HTML
+// bodies. Authentication is only attempted when a username is configured.
+func sendDigest(cfg smtpConfig, subject string, text string, html string) error {
+
+	var body bytes.Buffer
+	boundary, err := writeDigestBody(&body, text, html)
+	if err != nil {
+		return fmt.Errorf("error encoding digest, %v", err)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n", boundary)
+	fmt.Fprintf(&msg, "\r\n")
+	msg.Write(body.Bytes())
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host, _, err := net.SplitHostPort(cfg.Addr)
+		if err != nil {
+			return fmt.Errorf("error parsing SMTP address %s, %v", cfg.Addr, err)
+		}
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	if err := smtp.SendMail(cfg.Addr, auth, cfg.From, cfg.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("error sending digest, %v", err)
+	}
+	return nil
+}
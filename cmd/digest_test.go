@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpMessage is a message received by the test SMTP server
+type smtpMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// serveSMTP accepts a single SMTP session on a local port and sends the message
+// it receives on the returned channel
+func serveSMTP(t *testing.T) (string, <-chan smtpMessage) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	messages := make(chan smtpMessage, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		var msg smtpMessage
+		tp.PrintfLine("220 localhost ESMTP test")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch verb {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+			case "MAIL":
+				msg.From = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+				tp.PrintfLine("250 ok")
+			case "RCPT":
+				msg.To = append(msg.To, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+				tp.PrintfLine("250 ok")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				if msg.Data, err = tp.ReadDotBytes(); err != nil {
+					return
+				}
+				tp.PrintfLine("250 queued")
+				messages <- msg
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func TestSendDigest(t *testing.T) {
+
+	store := openTestStore(t)
+	now := time.Date(2019, time.September, 10, 12, 0, 0, 0, leagueLocation)
+	saveScrape(t, store, "4153", []game{
+		testGame(time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation), "4150", "4153"),
+		testGame(time.Date(2019, time.September, 19, 19, 0, 0, 0, leagueLocation), "4153", "4152"),
+	}, now)
+
+	d, err := buildDigest(store, []teamRef{{ID: "4153"}}, now, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Teams) != 1 || len(d.Teams[0].Games) != 1 || d.Teams[0].Games[0].Opponent != "Degenerates FC" {
+		t.Fatalf("got digest %+v, want the one game of the next week", d)
+	}
+	text, html, err := renderDigest(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, messages := serveSMTP(t)
+	cfg := smtpConfig{Addr: addr, From: "scraper@example.com", To: []string{"a@example.com", "b@example.com"}}
+	if err := sendDigest(cfg, "Megpies FC this week", text, html); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-messages
+	if msg.From != cfg.From || len(msg.To) != 2 || msg.To[1] != "b@example.com" {
+		t.Errorf("got envelope from %s to %v", msg.From, msg.To)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("Subject") != "Megpies FC this week" {
+		t.Errorf("subject %q", m.Header.Get("Subject"))
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("content type %q, %v", m.Header.Get("Content-Type"), err)
+	}
+
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	parts := make(map[string]string)
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(quotedprintable.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[mediaType] = string(b)
+	}
+	if parts["text/plain"] != text || parts["text/html"] != html {
+		t.Errorf("got parts %q", parts)
+	}
+	if !strings.Contains(text, "Thu Sep 12, 7:00 PM  Home vs Degenerates FC at Burnaby Indoor Soccer Centre") {
+		t.Errorf("text body is missing the game:\n%s", text)
+	}
+}
+
+// shortWriter fails once it has been given n bytes
+type shortWriter struct {
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written := w.n
+		w.n = 0
+		return written, io.ErrShortWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteDigestBodyCutShort(t *testing.T) {
+
+	var full bytes.Buffer
+	if _, err := writeDigestBody(&full, "Megpies FC vs Croatia U21", "<p>Megpies FC vs Croatia U21</p>"); err != nil {
+		t.Fatal(err)
+	}
+	// However little of the body gets written, the digest isn't sent
+	for n := 0; n < full.Len(); n++ {
+		if _, err := writeDigestBody(&shortWriter{n: n}, "Megpies FC vs Croatia U21", "<p>Megpies FC vs Croatia U21</p>"); err == nil {
+			t.Fatalf("no error when only %d of %d bytes were written", n, full.Len())
+		}
+	}
+}
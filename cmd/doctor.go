@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// The parts of the schedule page the scraper depends on. If the site renames any
+// of them the scrape finds nothing, so doctor checks they are all still there.
+var (
+	expectedSelects = []string{
+		"ctl00$mainContent$ctl01$ddlSeason",
+		"ctl00$mainContent$ctl01$ddlSeason_f",
+		"ctl00$mainContent$ctl01$ddlTeams",
+		"ctl00$mainContent$ctl01$ddlTeams_f",
+		"ctl00$mainContent$ctl01$ddlDivisions",
+		"ctl00$mainContent$ctl01$ddlDivisions_f",
+	}
+	expectedHiddenFields = []string{
+		"__EVENTTARGET",
+		"__VIEWSTATE",
+		"__VIEWSTATEGENERATOR",
+		"__EVENTVALIDATION",
+	}
+	expectedUpdatePanel = "ctl00_mainContent_ctl01_UpdatePanel4"
+	expectedButton      = "ctl00_mainContent_ctl01_btnGoF"
+	expectedColumns     = []string{"TIME", "VISITING TEAM", "SCORE", "HOME TEAM", "SCORE", "EVENT", "LOCATION"}
+	// expectedNoGames is what the postback says, in any case, in place of the grid
+	// when the team has no games
+	expectedNoGames = "no games"
+)
+
+// siteCheck is the outcome of checking one part of the site. A skipped check
+// couldn't be made and doesn't count as a failure.
+type siteCheck struct {
+	Check   string `json:"check"`
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// doctorCommand checks the schedule page still has everything the scraper relies
+// on and reports what is missing. It fails if anything is, for monitoring.
+func doctorCommand(args []string) error {
+
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	var configPath = fs.String("config", "", configUsage)
+	var teamName = fs.String("tn", "", "Team whose schedule is posted back for, to check the grid (default the first team listed)")
+	var format = fs.String("format", "text", "Report format, text or json")
+	var site siteFlags
+	site.register(fs)
+	fs.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown report format %s, expected text or json", *format)
+	}
+	if _, err := configure(fs, *configPath); err != nil {
+		return err
+	}
+	if err := site.apply(); err != nil {
+		return err
+	}
+	// Only the postback is cached, and the grid has to come from the site
+	siteClient.Cache = nil
+
+	checks := checkSite(context.Background(), *teamName)
+
+	var failed int
+	for _, c := range checks {
+		if !c.OK && !c.Skipped {
+			failed++
+		}
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(checks); err != nil {
+			return err
+		}
+	} else {
+		for _, c := range checks {
+			status := "ok     "
+			switch {
+			case c.Skipped:
+				status = "skipped"
+			case !c.OK:
+				status = "MISSING"
+			}
+			if c.Detail != "" {
+				fmt.Printf("%s %s, %s\n", status, c.Check, c.Detail)
+			} else {
+				fmt.Printf("%s %s\n", status, c.Check)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks of the site failed", failed, len(checks))
+	}
+	return nil
+}
+
+// checkSite fetches the schedule page, posts back for the team's games the way a
+// scrape does, and checks both responses
+func checkSite(ctx context.Context, teamName string) []siteCheck {
+
+	resp, err := getSoccerSchedule(ctx)
+	if err != nil {
+		return []siteCheck{{Check: "schedule page", Detail: err.Error()}}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return []siteCheck{{Check: "schedule page", Detail: err.Error()}}
+	}
+	page := inspectPage(body)
+	checks := []siteCheck{{Check: "schedule page", OK: true}}
+
+	for _, name := range expectedSelects {
+		sel, ok := page.selects[name]
+		c := siteCheck{Check: "select " + name, OK: ok && len(sel.values) > 0}
+		if ok && len(sel.values) == 0 {
+			c.Detail = "it has no options"
+		}
+		checks = append(checks, c)
+	}
+	for _, name := range expectedHiddenFields {
+		checks = append(checks, siteCheck{Check: "hidden field " + name, OK: page.hidden[name]})
+	}
+	checks = append(checks,
+		siteCheck{Check: "update panel " + expectedUpdatePanel, OK: page.ids[expectedUpdatePanel]},
+		siteCheck{Check: "button " + expectedButton, OK: page.ids[expectedButton]},
+	)
+
+	season := page.selects["ctl00$mainContent$ctl01$ddlSeason"].selected
+	checks = append(checks, siteCheck{Check: "selected season", OK: season != ""})
+	teamID, teamCheck := page.team(teamName)
+	checks = append(checks, teamCheck)
+	if season == "" || teamID == "" {
+		return append(checks, siteCheck{Check: "schedule grid", Skipped: true, Detail: "not checked, there is no season and team to post back for"})
+	}
+
+	// Press the Go button for the team, as a scrape does
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	viewStateInfo, _ := getViewStates(resp)
+	req, err := newSchedulePostback(teamID, season, "0", viewStateInfo, resp.Cookies())
+	if err == nil {
+		resp, err = siteClient.Do(ctx, req)
+	}
+	if err == nil {
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err != nil {
+		return append(checks, siteCheck{Check: "schedule postback", Detail: err.Error()})
+	}
+	checks = append(checks,
+		siteCheck{Check: "schedule postback", OK: true},
+		siteCheck{Check: "update panel " + expectedUpdatePanel + " in the postback", OK: bytes.Contains(body, []byte("|updatePanel|"+expectedUpdatePanel+"|"))},
+	)
+
+	columns, found := gridColumns(body)
+	if !found {
+		// The grid isn't rendered for a team without games, so its columns can
+		// only be checked when there are some. Anything else is a renamed grid.
+		if bytes.Contains(bytes.ToLower(body), []byte(expectedNoGames)) {
+			return append(checks, siteCheck{Check: "schedule grid gvFuture", Skipped: true, Detail: "not checked, the team has no games this season"})
+		}
+		return append(checks, siteCheck{Check: "schedule grid gvFuture", Detail: "it is not in the postback"})
+	}
+	checks = append(checks, siteCheck{Check: "schedule grid gvFuture", OK: true})
+	for i, want := range expectedColumns {
+		c := siteCheck{Check: fmt.Sprintf("grid column %d %s", i+1, want)}
+		switch {
+		case i >= len(columns):
+			c.Detail = "the grid has only " + fmt.Sprint(len(columns)) + " columns"
+		case columns[i] != want:
+			c.Detail = fmt.Sprintf("found %q instead", columns[i])
+		default:
+			c.OK = true
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// pageSelect is a select on the schedule page, its option values and texts and
+// the value of the selected option
+type pageSelect struct {
+	values   []string
+	texts    []string
+	selected string
+}
+
+// pageInspection is what is on the schedule page
+type pageInspection struct {
+	selects map[string]*pageSelect
+	hidden  map[string]bool
+	ids     map[string]bool
+}
+
+// inspectPage collects the selects, hidden fields and element IDs of the page
+func inspectPage(body []byte) pageInspection {
+
+	page := pageInspection{
+		selects: make(map[string]*pageSelect),
+		hidden:  make(map[string]bool),
+		ids:     make(map[string]bool),
+	}
+	var sel *pageSelect
+	var inOption bool
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return page
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			attrs := tagAttrs(z)
+			if id := attrs["id"]; id != "" {
+				page.ids[id] = true
+			}
+			switch string(name) {
+			case "select":
+				sel = &pageSelect{}
+				page.selects[attrs["name"]] = sel
+			case "option":
+				if sel == nil {
+					continue
+				}
+				sel.values = append(sel.values, attrs["value"])
+				sel.texts = append(sel.texts, "")
+				inOption = true
+				if _, ok := attrs["selected"]; ok {
+					sel.selected = attrs["value"]
+				}
+			case "input":
+				if attrs["type"] == "hidden" {
+					page.hidden[attrs["name"]] = true
+				}
+			}
+		case html.TextToken:
+			if sel != nil && inOption {
+				sel.texts[len(sel.texts)-1] += string(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "select":
+				sel, inOption = nil, false
+			case "option":
+				inOption = false
+			}
+		}
+	}
+}
+
+// team returns the ID of the named team in the team select the postback uses, or
+// of the first team listed if no name is given
+func (page pageInspection) team(teamName string) (string, siteCheck) {
+
+	sel, ok := page.selects["ctl00$mainContent$ctl01$ddlTeams_f"]
+	if !ok {
+		return "", siteCheck{Check: "team to post back for", Detail: "there is no team select"}
+	}
+	for i, value := range sel.values {
+		text := strings.TrimSpace(sel.texts[i])
+		if teamName == "" && value != "" && value != "0" || teamName != "" && text == teamName {
+			return value, siteCheck{Check: "team " + text, OK: true}
+		}
+	}
+	if teamName == "" {
+		return "", siteCheck{Check: "team to post back for", Detail: "no team is listed"}
+	}
+	return "", siteCheck{Check: "team " + teamName, Detail: "it is not listed"}
+}
+
+// tagAttrs returns the attributes of the current tag
+func tagAttrs(z *html.Tokenizer) map[string]string {
+	attrs := make(map[string]string)
+	for {
+		key, val, more := z.TagAttr()
+		if len(key) > 0 {
+			attrs[string(key)] = string(val)
+		}
+		if !more {
+			return attrs
+		}
+	}
+}
+
+// gridColumns returns the header texts of the gvFuture grid in the postback
+// response, and whether the grid is there at all
+func gridColumns(body []byte) ([]string, bool) {
+
+	var columns []string
+	var found, inHeader bool
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return columns, found
+		case html.StartTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "table":
+				if hasAttr && strings.HasSuffix(tagAttrs(z)["id"], "gvFuture") {
+					found = true
+				}
+			case "th":
+				if found {
+					inHeader = true
+					columns = append(columns, "")
+				}
+			}
+		case html.TextToken:
+			if inHeader {
+				columns[len(columns)-1] += string(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "th":
+				if inHeader {
+					columns[len(columns)-1] = strings.TrimSpace(columns[len(columns)-1])
+					inHeader = false
+				}
+			case "tr":
+				// The header is the first row
+				if len(columns) > 0 {
+					return columns, found
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestCheckSiteGrid(t *testing.T) {
+
+	page, err := ioutil.ReadFile("example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed := bytes.Replace(page, []byte("gvFuture"), []byte("gvNone"), -1)
+	// The postback for a team without games says so in place of the grid
+	noGames := bytes.Replace(renamed, []byte(`<table cellspacing="0" rules="cols" id="ctl00_mainContent_ctl01_gvNone"`),
+		[]byte(`<span>No games scheduled</span><table cellspacing="0" rules="cols"`), 1)
+
+	tests := []struct {
+		name     string
+		postback []byte
+		ok       bool
+		skipped  bool
+	}{
+		{"grid", page, true, false},
+		{"renamed grid", renamed, false, false},
+		{"no games", noGames, false, true},
+	}
+
+	transport, limiter := siteClient.Client.Transport, siteClient.Limiter
+	defer func() { siteClient.Client.Transport, siteClient.Limiter = transport, limiter }()
+	siteClient.Limiter = newTokenBucket(1000, 10)
+	for _, tt := range tests {
+		siteClient.Client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			body := page
+			if r.Method == "POST" {
+				body = tt.postback
+			}
+			return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewReader(body)), Request: r}, nil
+		})
+
+		var grid *siteCheck
+		checks := checkSite(context.Background(), "Megpies FC")
+		for i, c := range checks {
+			if c.Check == "schedule grid gvFuture" {
+				grid = &checks[i]
+			}
+			if c.Check == "team Megpies FC" && !c.OK {
+				t.Errorf("%s: team check failed, %+v", tt.name, c)
+			}
+		}
+		if grid == nil {
+			t.Errorf("%s: the grid wasn't checked", tt.name)
+		} else if grid.OK != tt.ok || grid.Skipped != tt.skipped {
+			t.Errorf("%s: got grid check %+v, want ok %v and skipped %v", tt.name, *grid, tt.ok, tt.skipped)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// sourceProperty marks the events created by the sync, only events carrying
+	// it are ever changed or deleted
+	sourceProperty = "8rinksSource"
+	sourceValue    = "8rinks-scraper"
+	// gameKeyProperty holds the identity key of the game an event is for
+	gameKeyProperty = "8rinksGameKey"
+	// teamProperty holds the ID of the team the event was synced for
+	teamProperty = "8rinksTeamID"
+)
+
+// googleSink keeps a Google calendar in step with the schedule. Events are found
+// by private extended properties, so events the sync didn't create are left alone.
+type googleSink struct {
+	unbuffered
+	srv        *calendar.Service
+	calendarID string
+	pending    string // name of a team calendar that is yet to be created
+}
+
+// newGoogleSink returns a sink for the Google calendar
+func newGoogleSink(srv *calendar.Service, calendarID string) *googleSink {
+	return &googleSink{srv: srv, calendarID: calendarID}
+}
+
+// newPendingGoogleSink returns a sink for a team calendar that doesn't exist yet,
+// so a dry run can plan it as empty. It can't be written to.
+func newPendingGoogleSink(name string) *googleSink {
+	return &googleSink{pending: name}
+}
+
+func (s *googleSink) Name() string {
+	if s.pending != "" {
+		return "google:" + s.pending + " (to be created)"
+	}
+	return "google:" + s.calendarID
+}
+
+// List returns the events the sync created for the team
+func (s *googleSink) List(ctx context.Context, teamID string) ([]calendarEvent, error) {
+
+	var events []calendarEvent
+	if s.pending != "" {
+		return events, nil
+	}
+	call := s.srv.Events.List(s.calendarID).
+		PrivateExtendedProperty(sourceProperty + "=" + sourceValue).
+		ShowDeleted(false).
+		SingleEvents(true).
+		MaxResults(250).
+		Context(ctx)
+	for pageToken := ""; ; {
+		page, err := call.PageToken(pageToken).Do()
+		if err != nil {
+			return nil, fmt.Errorf("error listing events of calendar %s, %v", s.calendarID, err)
+		}
+		for _, ev := range page.Items {
+			if ev.ExtendedProperties == nil {
+				continue
+			}
+			key := ev.ExtendedProperties.Private[gameKeyProperty]
+			if key == "" {
+				continue
+			}
+			listed := calendarEvent{
+				Key:         key,
+				ID:          ev.Id,
+				Team:        ev.ExtendedProperties.Private[teamProperty],
+				Summary:     ev.Summary,
+				Location:    ev.Location,
+				Description: ev.Description,
+				Start:       googleEventTime(ev.Start),
+				End:         googleEventTime(ev.End),
+			}
+			if forTeam(listed, teamID) {
+				events = append(events, listed)
+			}
+		}
+		pageToken = page.NextPageToken
+		if pageToken == "" {
+			return events, nil
+		}
+	}
+}
+
+// Upsert patches the event, or inserts it if it has no ID
+func (s *googleSink) Upsert(ctx context.Context, ev calendarEvent) error {
+
+	if s.pending != "" {
+		return fmt.Errorf("calendar %s hasn't been created", s.pending)
+	}
+	want := googleEvent(ev)
+	if ev.ID == "" {
+		_, err := s.srv.Events.Insert(s.calendarID, want).Context(ctx).Do()
+		return err
+	}
+	// Send the text fields even when empty so a cleared score is cleared
+	want.ForceSendFields = []string{"Description", "Location"}
+	_, err := s.srv.Events.Patch(s.calendarID, ev.ID, want).Context(ctx).Do()
+	return err
+}
+
+// Delete deletes the event
+func (s *googleSink) Delete(ctx context.Context, ev calendarEvent) error {
+	err := s.srv.Events.Delete(s.calendarID, ev.ID).Context(ctx).Do()
+	if err != nil && !isGone(err) {
+		return err
+	}
+	return nil
+}
+
+// googleEvent returns the Google event for an event, tagged with its game key and
+// team
+func googleEvent(ev calendarEvent) *calendar.Event {
+	return &calendar.Event{
+		Summary:     ev.Summary,
+		Location:    ev.Location,
+		Description: ev.Description,
+		Start: &calendar.EventDateTime{
+			DateTime: ev.Start.In(leagueLocation).Format(time.RFC3339),
+			TimeZone: leagueLocation.String(),
+		},
+		End: &calendar.EventDateTime{
+			DateTime: ev.End.In(leagueLocation).Format(time.RFC3339),
+			TimeZone: leagueLocation.String(),
+		},
+		ExtendedProperties: &calendar.EventExtendedProperties{
+			Private: map[string]string{
+				sourceProperty:  sourceValue,
+				gameKeyProperty: ev.Key,
+				teamProperty:    ev.Team,
+			},
+		},
+	}
+}
+
+// googleEventTime returns the instant of an event time, which Google may return
+// with a different offset than it was sent with. All-day times are zero.
+func googleEventTime(t *calendar.EventDateTime) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	parsed, err := time.Parse(time.RFC3339, t.DateTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+// isGone reports whether the error is Google saying the event is already deleted
+func isGone(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && (apiErr.Code == http.StatusGone || apiErr.Code == http.StatusNotFound)
+}
+
+// findTeamCalendar returns the ID of the calendar with the given name, or an empty
+// ID if there isn't one
+func findTeamCalendar(ctx context.Context, srv *calendar.Service, name string) (string, error) {
+	entry, err := findCalendarListEntry(ctx, srv, name)
+	if err != nil || entry == nil {
+		return "", err
+	}
+	return entry.Id, nil
+}
+
+// ensureTeamCalendar returns the ID of the calendar with the given name, creating
+// it if there isn't one. The calendar is kept in the league time zone.
+func ensureTeamCalendar(ctx context.Context, srv *calendar.Service, name string) (string, error) {
+
+	entry, err := findCalendarListEntry(ctx, srv, name)
+	if err != nil {
+		return "", err
+	}
+	if entry != nil {
+		if entry.TimeZone != leagueLocation.String() {
+			_, err := srv.Calendars.Patch(entry.Id, &calendar.Calendar{TimeZone: leagueLocation.String()}).Context(ctx).Do()
+			if err != nil {
+				return "", fmt.Errorf("error setting time zone of calendar %s, %v", name, err)
+			}
+		}
+		log.Debugf("ensureTeamCalendar: found %s, %s", name, entry.Id)
+		return entry.Id, nil
+	}
+
+	cal, err := srv.Calendars.Insert(&calendar.Calendar{
+		Summary:     name,
+		Description: "Games scraped from the 8 Rinks schedule, changes made here will be overwritten.",
+		TimeZone:    leagueLocation.String(),
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("error creating calendar %s, %v", name, err)
+	}
+	log.Infof("Created calendar %s, %s", name, cal.Id)
+	return cal.Id, nil
+}
+
+// findCalendarListEntry returns the calendar the user owns with the given name,
+// or nil if there isn't one
+func findCalendarListEntry(ctx context.Context, srv *calendar.Service, name string) (*calendar.CalendarListEntry, error) {
+
+	call := srv.CalendarList.List().MinAccessRole("owner").Context(ctx)
+	for pageToken := ""; ; {
+		page, err := call.PageToken(pageToken).Do()
+		if err != nil {
+			return nil, fmt.Errorf("error listing calendars, %v", err)
+		}
+		for _, entry := range page.Items {
+			if entry.Summary == name {
+				return entry, nil
+			}
+		}
+		pageToken = page.NextPageToken
+		if pageToken == "" {
+			return nil, nil
+		}
+	}
+}
+
+// shareCalendar gives each email read-only access to the calendar, unless it can
+// already see it. Access is never taken away.
+func shareCalendar(ctx context.Context, srv *calendar.Service, calendarID string, emails []string) error {
+
+	if len(emails) == 0 {
+		return nil
+	}
+
+	shared := make(map[string]bool)
+	call := srv.Acl.List(calendarID).Context(ctx)
+	for pageToken := ""; ; {
+		page, err := call.PageToken(pageToken).Do()
+		if err != nil {
+			return fmt.Errorf("error listing who calendar %s is shared with, %v", calendarID, err)
+		}
+		for _, rule := range page.Items {
+			if rule.Scope != nil && rule.Scope.Type == "user" && rule.Role != "none" && rule.Role != "freeBusyReader" {
+				shared[strings.ToLower(rule.Scope.Value)] = true
+			}
+		}
+		pageToken = page.NextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+
+	for _, email := range emails {
+		if shared[strings.ToLower(email)] {
+			continue
+		}
+		rule := &calendar.AclRule{
+			Role:  "reader",
+			Scope: &calendar.AclRuleScope{Type: "user", Value: email},
+		}
+		if _, err := srv.Acl.Insert(calendarID, rule).SendNotifications(true).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("error sharing calendar %s with %s, %v", calendarID, email, err)
+		}
+		log.Infof("Shared calendar %s with %s", calendarID, email)
+	}
+	return nil
+}
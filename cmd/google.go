@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/calendar/v3"
+)
+
+// tokenFlow runs an interactive authorization flow for a token
+type tokenFlow func(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error)
+
+// Retrieve a token, saves the token, then returns the generated client.
+func getClient(ctx context.Context, config *oauth2.Config, store *tokenStore, flow tokenFlow) (*http.Client, error) {
+	// The token store keeps the user's access and refresh tokens. The token is
+	// created when the authorization flow completes for the first time, and
+	// saved again whenever it is refreshed.
+	tok, err := store.Load()
+	if os.IsNotExist(err) {
+		authCtx, cancel := context.WithTimeout(ctx, authTimeout)
+		tok, err = flow(authCtx, config)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to retrieve token: %v", err)
+		}
+		err = store.Save(tok)
+	}
+	if err != nil {
+		return nil, err
+	}
+	src := newPersistingTokenSource(config.TokenSource(ctx, tok), store, tok)
+	return oauth2.NewClient(ctx, src), nil
+}
+
+// authTimeout is how long the user has to finish authorizing
+const authTimeout = 5 * time.Minute
+
+// googleFlow returns the authorization flow for Google. With flow auto, the
+// browser flow is used without trying to open a browser when the machine looks
+// headless, the link is printed along with how to forward the redirect to it over
+// SSH. Google doesn't allow the Calendar scope in its device flow.
+func googleFlow(flow string) tokenFlow {
+	return func(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+		switch flow {
+		case "browser":
+			return getTokenFromWeb(ctx, config, false)
+		case "auto", "":
+			return getTokenFromWeb(ctx, config, isHeadless())
+		}
+		return nil, fmt.Errorf("unknown auth flow %q, expected auto or browser", flow)
+	}
+}
+
+// Request a token from the web, then returns the retrieved token.
+//
+// Google redirects back to a server listening on an ephemeral loopback port,
+// so there is no code to paste. The state is random, and PKCE ties the code to
+// this process in case another local process sees the redirect. On a headless
+// machine the browser is on another one, which has to forward the port.
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config, headless bool) (*oauth2.Token, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for the authorization redirect: %v", err)
+	}
+	defer ln.Close()
+
+	cfg := *config
+	cfg.RedirectURL = fmt.Sprintf("http://%s/", ln.Addr())
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			http.Error(w, "Unexpected state, please try again.", http.StatusBadRequest)
+			return
+		}
+		var res result
+		if e := q.Get("error"); e != "" {
+			res.err = fmt.Errorf("authorization failed: %s", e)
+			fmt.Fprintln(w, "Authorization failed, you can close this window.")
+		} else {
+			res.code = q.Get("code")
+			fmt.Fprintln(w, "Authorization complete, you can close this window.")
+		}
+		select {
+		case results <- res:
+		default:
+		}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	authURL := cfg.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	if headless {
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		fmt.Printf("There is no browser here, so forward the port of the redirect from the machine with one, for example:\n"+
+			"  ssh -L %s:127.0.0.1:%s <this machine>\n"+
+			"then go to the following link in its browser: \n%v\n", port, port, authURL)
+	} else {
+		if err := openBrowser(authURL); err != nil {
+			log.Debugf("getTokenFromWeb: unable to open browser, %v", err)
+		}
+		fmt.Printf("Authorize this app in your browser, if it didn't open go to the following link: \n%v\n", authURL)
+	}
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			return nil, res.err
+		}
+		tok, err := cfg.Exchange(ctx, res.code, oauth2.VerifierOption(verifier))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to retrieve token from web: %v", err)
+		}
+		return tok, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out waiting for authorization")
+	}
+}
+
+// randomState returns an unguessable value for the OAuth state parameter
+func randomState() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// isHeadless reports whether there is probably no browser to open, either because
+// this is an SSH session or there is no display
+func isHeadless() bool {
+	if os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" {
+		return true
+	}
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		return false
+	}
+	return os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == ""
+}
+
+// openBrowser opens the URL in the user's default browser
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
+
+// Credentials are looked for in these environment variables, then in the user
+// config directory
+const (
+	googleCredentialsJSONEnv = "EIGHTRINKS_GOOGLE_CREDENTIALS_JSON" // the credentials themselves
+	googleCredentialsEnv     = "EIGHTRINKS_GOOGLE_CREDENTIALS"      // a path to them
+)
+
+// googleAuth is how to authenticate with Google. Individuals use the interactive
+// OAuth flow, unattended syncs use a service account, optionally impersonating a
+// user of a Workspace domain through domain-wide delegation.
+type googleAuth struct {
+	Method      string // auto, oauth or service-account, auto goes by the type of the credentials
+	Credentials string // path to the credentials, see loadGoogleCredentials
+	Impersonate string // email of the user a service account acts as
+	Flow        string // interactive flow for oauth, see googleFlow
+	Tokens      *tokenStore
+}
+
+// loadGoogleCredentials returns the OAuth client or service account key from the
+// path if given, then from the environment, then from google-credentials.json in
+// the user config directory. GOOGLE_APPLICATION_CREDENTIALS is honoured too.
+func loadGoogleCredentials(path string) ([]byte, error) {
+	if path == "" {
+		if j := os.Getenv(googleCredentialsJSONEnv); j != "" {
+			return []byte(j), nil
+		}
+		path = os.Getenv(googleCredentialsEnv)
+	}
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		dir, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "google-credentials.json")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read Google credentials, set -credentials or %s: %v", googleCredentialsEnv, err)
+	}
+	return b, nil
+}
+
+// googleScope is the access the sync needs, to manage events and to create and
+// share the calendars of teams
+const googleScope = calendar.CalendarScope
+
+// newCalendarService authenticates with Google and returns a Calendar client that
+// can manage calendars and their events
+func newCalendarService(ctx context.Context, auth googleAuth) (*calendar.Service, error) {
+	b, err := loadGoogleCredentials(auth.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	method := auth.Method
+	if method == "" || method == "auto" {
+		var creds struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(b, &creds)
+		method = "oauth"
+		if creds.Type == "service_account" {
+			method = "service-account"
+		}
+	}
+
+	var client *http.Client
+	switch method {
+	case "service-account":
+		config, err := google.JWTConfigFromJSON(b, googleScope)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse service account key: %v", err)
+		}
+		// With domain-wide delegation the service account acts as the user, without
+		// it the service account only has its own calendars
+		config.Subject = auth.Impersonate
+		client = config.Client(ctx)
+	case "oauth":
+		if auth.Impersonate != "" {
+			return nil, fmt.Errorf("impersonating %s needs a service account", auth.Impersonate)
+		}
+		// If modifying these scopes, delete your previously saved token.
+		config, err := google.ConfigFromJSON(b, googleScope)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse client secret file to config: %v", err)
+		}
+		client, err = getClient(ctx, config, auth.Tokens, googleFlow(auth.Flow))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth method %q, expected auto, oauth or service-account", method)
+	}
+
+	srv, err := calendar.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve Calendar client: %v", err)
+	}
+	return srv, nil
+}
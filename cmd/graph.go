@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/microsoft"
+)
+
+const (
+	// graphURL is the Microsoft Graph API the sink talks to by default
+	graphURL = "https://graph.microsoft.com/v1.0"
+	// graphKeyProperty is the single value extended property holding the
+	// identity key of the game an event is for. Only events carrying it are
+	// ever changed or deleted.
+	graphKeyProperty = "String {6f1c2b8e-3d4a-4e5f-9a7b-8c0d1e2f3a4b} Name 8rinksGameKey"
+	// graphTeamProperty holds the ID of the team the event was synced for
+	graphTeamProperty = "String {6f1c2b8e-3d4a-4e5f-9a7b-8c0d1e2f3a4b} Name 8rinksTeamID"
+	// graphTimeLayout is how Graph writes event times, without an offset
+	graphTimeLayout = "2006-01-02T15:04:05.9999999"
+)
+
+// graphScopes are what the sink needs, offline access for a refresh token
+var graphScopes = []string{"offline_access", "Calendars.ReadWrite"}
+
+// graphSink keeps an Outlook calendar in step with the schedule through the
+// Microsoft Graph API
+type graphSink struct {
+	unbuffered
+	BaseURL    string // the Graph API, graphURL unless it is being stood in for
+	CalendarID string // empty for the user's default calendar
+	Client     *http.Client
+}
+
+// newGraphClient authorizes with the device code flow, for a public client
+// registered in Azure AD, and returns a client that keeps the token fresh
+func newGraphClient(ctx context.Context, clientID string, tenant string, store *tokenStore) (*http.Client, error) {
+	if clientID == "" {
+		return nil, fmt.Errorf("the graph sink needs the -ms-client-id of an Azure AD app registration")
+	}
+	config := &oauth2.Config{
+		ClientID: clientID,
+		Endpoint: microsoft.AzureADEndpoint(tenant),
+		Scopes:   graphScopes,
+	}
+	return getClient(ctx, config, store, getTokenFromDevice)
+}
+
+// getTokenFromDevice runs the device authorization flow, for machines without a
+// browser. The user enters a code on another device while this one polls for the
+// token.
+func getTokenFromDevice(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	da, err := config.DeviceAuth(ctx, oauth2.AccessTypeOffline)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start device authorization: %v", err)
+	}
+	fmt.Printf("Go to %v on any device and enter the code %v\n", da.VerificationURI, da.UserCode)
+
+	tok, err := config.DeviceAccessToken(ctx, da)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve token from device authorization: %v", err)
+	}
+	return tok, nil
+}
+
+// newGraphSink returns a sink for the Outlook calendar, the user's default
+// calendar if calendarID is empty
+func newGraphSink(client *http.Client, baseURL string, calendarID string) *graphSink {
+	if baseURL == "" {
+		baseURL = graphURL
+	}
+	return &graphSink{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		CalendarID: calendarID,
+		Client:     client,
+	}
+}
+
+func (s *graphSink) Name() string {
+	if s.CalendarID == "" {
+		return "graph:default"
+	}
+	return "graph:" + s.CalendarID
+}
+
+// graphEvent is the part of a Graph event the sink reads and writes
+type graphEvent struct {
+	ID      string `json:"id,omitempty"`
+	Subject string `json:"subject"`
+	Body    struct {
+		ContentType string `json:"contentType"`
+		Content     string `json:"content"`
+	} `json:"body"`
+	Location struct {
+		DisplayName string `json:"displayName"`
+	} `json:"location"`
+	Start                         graphTime            `json:"start"`
+	End                           graphTime            `json:"end"`
+	SingleValueExtendedProperties []graphExtendedValue `json:"singleValueExtendedProperties,omitempty"`
+}
+
+type graphTime struct {
+	DateTime string `json:"dateTime"`
+	TimeZone string `json:"timeZone"`
+}
+
+type graphExtendedValue struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// eventsURL is the events collection of the calendar
+func (s *graphSink) eventsURL() string {
+	if s.CalendarID == "" {
+		return s.BaseURL + "/me/calendar/events"
+	}
+	return s.BaseURL + "/me/calendars/" + url.PathEscape(s.CalendarID) + "/events"
+}
+
+// List returns the events carrying a game key that are the team's. Times are asked
+// for in UTC and bodies as text so they compare with the events the sync writes.
+func (s *graphSink) List(ctx context.Context, teamID string) ([]calendarEvent, error) {
+
+	q := url.Values{}
+	q.Set("$filter", fmt.Sprintf("singleValueExtendedProperties/Any(ep: ep/id eq '%s' and ep/value ne null)", graphKeyProperty))
+	q.Set("$expand", fmt.Sprintf("singleValueExtendedProperties($filter=id eq '%s' or id eq '%s')", graphKeyProperty, graphTeamProperty))
+	q.Set("$top", "100")
+	next := s.eventsURL() + "?" + q.Encode()
+
+	var events []calendarEvent
+	for next != "" {
+		var page struct {
+			Value    []graphEvent `json:"value"`
+			NextLink string       `json:"@odata.nextLink"`
+		}
+		if err := s.do(ctx, "GET", next, nil, &page); err != nil {
+			return nil, fmt.Errorf("error listing events of %s, %v", s.Name(), err)
+		}
+		for _, ev := range page.Value {
+			listed := calendarEvent{
+				ID:          ev.ID,
+				Summary:     ev.Subject,
+				Location:    ev.Location.DisplayName,
+				Description: strings.TrimSpace(ev.Body.Content),
+				Start:       ev.Start.time(),
+				End:         ev.End.time(),
+			}
+			for _, p := range ev.SingleValueExtendedProperties {
+				switch {
+				case strings.EqualFold(p.ID, graphKeyProperty):
+					listed.Key = p.Value
+				case strings.EqualFold(p.ID, graphTeamProperty):
+					listed.Team = p.Value
+				}
+			}
+			if listed.Key != "" && forTeam(listed, teamID) {
+				events = append(events, listed)
+			}
+		}
+		next = page.NextLink
+	}
+	return events, nil
+}
+
+// Upsert updates the event, or creates it if it has no ID
+func (s *graphSink) Upsert(ctx context.Context, ev calendarEvent) error {
+
+	want := graphEvent{Subject: ev.Summary}
+	want.Body.ContentType = "text"
+	want.Body.Content = ev.Description
+	want.Location.DisplayName = ev.Location
+	want.Start = newGraphTime(ev.Start)
+	want.End = newGraphTime(ev.End)
+	want.SingleValueExtendedProperties = []graphExtendedValue{
+		{ID: graphKeyProperty, Value: ev.Key},
+		{ID: graphTeamProperty, Value: ev.Team},
+	}
+
+	if ev.ID == "" {
+		return s.do(ctx, "POST", s.eventsURL(), want, nil)
+	}
+	return s.do(ctx, "PATCH", s.BaseURL+"/me/events/"+url.PathEscape(ev.ID), want, nil)
+}
+
+// Delete deletes the event
+func (s *graphSink) Delete(ctx context.Context, ev calendarEvent) error {
+	err := s.do(ctx, "DELETE", s.BaseURL+"/me/events/"+url.PathEscape(ev.ID), nil, nil)
+	if err != nil && !isGraphNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// graphError is an error response from Graph
+type graphError struct {
+	Status int
+	Code   string
+	Msg    string
+}
+
+func (e *graphError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Msg)
+}
+
+// isGraphNotFound reports whether the error is Graph saying there is no such event
+func isGraphNotFound(err error) bool {
+	gerr, ok := err.(*graphError)
+	return ok && (gerr.Status == http.StatusNotFound || gerr.Status == http.StatusGone)
+}
+
+// do sends a request to Graph with in as the JSON body, and decodes the JSON
+// response into out
+func (s *graphSink) do(ctx context.Context, method string, target string, in interface{}, out interface{}) error {
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Add("Prefer", `outlook.timezone="UTC"`)
+	req.Header.Add("Prefer", `outlook.body-content-type="text"`)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		gerr := &graphError{Status: resp.StatusCode, Msg: strings.TrimSpace(string(b))}
+		var e struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error.Code != "" {
+			gerr.Code, gerr.Msg = e.Error.Code, e.Error.Message
+		}
+		return gerr
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error parsing response to %s %s, %v", method, target, err)
+	}
+	return nil
+}
+
+// newGraphTime returns t as a Graph time in the league time zone
+func newGraphTime(t time.Time) graphTime {
+	return graphTime{
+		DateTime: t.In(leagueLocation).Format("2006-01-02T15:04:05"),
+		TimeZone: leagueLocation.String(),
+	}
+}
+
+// time returns the instant of a Graph time, zero if its zone isn't known
+func (gt graphTime) time() time.Time {
+	loc := time.UTC
+	if gt.TimeZone != "" && gt.TimeZone != "UTC" {
+		var err error
+		if loc, err = time.LoadLocation(gt.TimeZone); err != nil {
+			return time.Time{}
+		}
+	}
+	t, err := time.ParseInLocation(graphTimeLayout, gt.DateTime, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
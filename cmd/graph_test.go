@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphSync(t *testing.T) {
+
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	games := []game{testGame(kickoff, "4150", "4153"), testGame(kickoff.AddDate(0, 0, 7), "4153", "4152")}
+	assignGameKeys(nil, games, time.Time{})
+
+	// The calendar holds the first game, listed on a second page, a duplicate of
+	// it and the event of a game that is no longer scheduled
+	listed := func(id string, key string, start time.Time) map[string]interface{} {
+		return map[string]interface{}{
+			"id":       id,
+			"subject":  "Megpies FC vs Degenerates FC (Home)",
+			"body":     map[string]string{"contentType": "text", "content": ""},
+			"location": map[string]string{"displayName": "Burnaby Indoor Soccer Centre"},
+			"start":    map[string]string{"dateTime": start.UTC().Format("2006-01-02T15:04:05.0000000"), "timeZone": "UTC"},
+			"end":      map[string]string{"dateTime": start.Add(gameDuration).UTC().Format("2006-01-02T15:04:05.0000000"), "timeZone": "UTC"},
+			"singleValueExtendedProperties": []map[string]string{
+				{"id": graphKeyProperty, "value": key},
+				{"id": graphTeamProperty, "value": "4153"},
+			},
+		}
+	}
+
+	var requests []string
+	var created []graphEvent
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("%s %s without the token", r.Method, r.URL.Path)
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("page") == "":
+			if !strings.Contains(r.URL.Query().Get("$filter"), graphKeyProperty) {
+				t.Errorf("events aren't filtered on the game key, %s", r.URL.RawQuery)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"value":           []interface{}{listed("gone", "733-483-4150-4153-9", kickoff)},
+				"@odata.nextLink": srv.URL + "/me/calendar/events?page=2",
+			})
+		case r.Method == "GET":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"value": []interface{}{
+					listed("first", games[0].Key, kickoff),
+					listed("duplicate", games[0].Key, kickoff),
+				},
+			})
+		case r.Method == "POST" || r.Method == "PATCH":
+			var ev graphEvent
+			if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+				t.Errorf("%s body isn't JSON, %v", r.Method, err)
+			}
+			created = append(created, ev)
+			ev.ID = "new"
+			json.NewEncoder(w).Encode(ev)
+		case r.Method == "DELETE" && strings.HasSuffix(r.URL.Path, "/gone"):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": "ErrorItemNotFound", "message": "gone"}})
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r.Header.Set("Authorization", "Bearer token")
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	games[0].Location = "Burnaby 8 Rinks"
+	if _, err := reconcile(context.Background(), newGraphSink(client, srv.URL, ""), "4153", "733", games, false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"GET /me/calendar/events",
+		"GET /me/calendar/events",
+		"PATCH /me/events/first",
+		"POST /me/calendar/events",
+		"DELETE /me/events/duplicate",
+		"DELETE /me/events/gone",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got requests\n%s\nwant\n%s", strings.Join(requests, "\n"), strings.Join(want, "\n"))
+	}
+	if len(created) != 2 || created[0].Location.DisplayName != "Burnaby 8 Rinks" {
+		t.Fatalf("got events %+v", created)
+	}
+	ev := created[1]
+	if ev.Subject != "Megpies FC vs Croatia U21 (Away)" || ev.Start.TimeZone != leagueLocation.String() || ev.Start.DateTime != "2019-09-19T19:00:00" {
+		t.Errorf("created event %+v", ev)
+	}
+	props := make(map[string]string)
+	for _, p := range ev.SingleValueExtendedProperties {
+		props[p.ID] = p.Value
+	}
+	if props[graphKeyProperty] != games[1].Key || props[graphTeamProperty] != "4153" {
+		t.Errorf("created event is tagged %v", props)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling a function
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
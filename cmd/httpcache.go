@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// diskCache keeps responses from the site on disk. Pages fetched with GET are
+// kept with their validators and revalidated with a conditional request every
+// time. Postback responses can't be revalidated, so they are kept by what they
+// are for, the season, division, team and dates, and reused until they are TTL
+// old. Cookies are never written to disk.
+type diskCache struct {
+	Dir string
+	TTL time.Duration
+}
+
+// cacheEntry is a response as it is kept on disk
+type cacheEntry struct {
+	URL      string      `json:"url"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	StoredAt time.Time   `json:"stored_at"`
+}
+
+// postbackKey is what a postback response is for
+type postbackKey struct {
+	Season   string
+	Division string
+	Team     string
+	From     string // the date range, empty for the whole season
+	To       string
+}
+
+// hash addresses the postback response in the cache
+func (k postbackKey) hash() string {
+	return hashKey(strings.Join([]string{k.Season, k.Division, k.Team, k.From, k.To}, "\x00"))
+}
+
+// defaultCacheDir is where responses are cached unless -cache-dir says otherwise
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "8rinks-scraper")
+}
+
+// loadGet returns the cached response to a GET of the URL, or nil
+func (c *diskCache) loadGet(url string) *cacheEntry {
+	return c.load(filepath.Join(c.Dir, "get", hashKey(url)+".json"))
+}
+
+// storeGet caches the response to a GET if it can be revalidated later
+func (c *diskCache) storeGet(url string, resp *http.Response, body []byte) {
+	if resp.StatusCode != http.StatusOK || (resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "") {
+		return
+	}
+	c.store(filepath.Join(c.Dir, "get", hashKey(url)+".json"), url, resp, body)
+}
+
+// cachedGet sends the GET with the validators of the cached response, if there
+// is one, and returns the cached response when the site says it is still current
+func (c *scrapeClient) cachedGet(ctx context.Context, req *http.Request) (*http.Response, error) {
+
+	target := req.URL.String()
+	cached := c.Cache.loadGet(target)
+	if cached != nil {
+		req = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if modified := cached.Header.Get("Last-Modified"); modified != "" {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		log.Debugf("cachedGet: %s not modified, using the cached response", target)
+		return cached.response(req, resp), nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.Cache.storeGet(target, resp, body)
+	return resp, nil
+}
+
+// loadPostback returns the cached postback response for the key if it is fresh
+func (c *diskCache) loadPostback(key postbackKey) *cacheEntry {
+	e := c.load(filepath.Join(c.Dir, "postback", key.hash()+".json"))
+	if e == nil || time.Since(e.StoredAt) > c.TTL {
+		return nil
+	}
+	return e
+}
+
+// storePostback caches a postback response
+func (c *diskCache) storePostback(key postbackKey, url string, resp *http.Response, body []byte) {
+	c.store(filepath.Join(c.Dir, "postback", key.hash()+".json"), url, resp, body)
+}
+
+func (c *diskCache) load(path string) *cacheEntry {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		log.Warnf("load: ignoring unreadable cache entry %s, %v", path, err)
+		return nil
+	}
+	return &e
+}
+
+// store writes the entry, a failure only costs the next run a request
+func (c *diskCache) store(path string, url string, resp *http.Response, body []byte) {
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+	b, err := json.Marshal(cacheEntry{
+		URL:      url,
+		Status:   resp.StatusCode,
+		Header:   header,
+		Body:     body,
+		StoredAt: time.Now(),
+	})
+	if err == nil {
+		err = writeFileAtomic(path, b, 0600)
+	}
+	if err != nil {
+		log.Warnf("store: error caching %s, %v", url, err)
+	}
+}
+
+// response rebuilds the cached response, with the cookies of a fresh one
+func (e *cacheEntry) response(req *http.Request, fresh *http.Response) *http.Response {
+	header := e.Header.Clone()
+	if fresh != nil {
+		for _, c := range fresh.Header.Values("Set-Cookie") {
+			header.Add("Set-Cookie", c)
+		}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// prune removes GET responses not stored in maxAge and postback responses past
+// their TTL, or everything with all, and returns how many it removed
+func (c *diskCache) prune(maxAge time.Duration, all bool) (int, error) {
+
+	var removed int
+	for _, sub := range []string{"get", "postback"} {
+		limit := maxAge
+		if sub == "postback" && c.TTL < limit {
+			limit = c.TTL
+		}
+		dir := filepath.Join(c.Dir, sub)
+		infos, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return removed, fmt.Errorf("error reading cache, %v", err)
+		}
+		for _, info := range infos {
+			if info.IsDir() || (!all && time.Since(info.ModTime()) <= limit) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+				return removed, fmt.Errorf("error pruning cache, %v", err)
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func hashKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheCommand manages the response cache
+//
+//	cache prune [-max-age 168h] [-all]
+func cacheCommand(args []string) error {
+
+	if len(args) == 0 || args[0] != "prune" {
+		return fmt.Errorf("usage: cache prune [-cache-dir dir] [-max-age duration] [-all]")
+	}
+	fs := flag.NewFlagSet("cache prune", flag.ExitOnError)
+	var dir = fs.String("cache-dir", defaultCacheDir(), "Directory responses from the site are cached in")
+	var ttl = fs.Duration("cache-ttl", 10*time.Minute, "How long the schedule of a team is reused, older postback responses are removed")
+	var maxAge = fs.Duration("max-age", 7*24*time.Hour, "Remove pages that haven't been stored for this long")
+	var all = fs.Bool("all", false, "Remove everything in the cache")
+	fs.Parse(args[1:])
+
+	if *dir == "" {
+		return fmt.Errorf("no cache directory, give one with -cache-dir")
+	}
+	c := &diskCache{Dir: *dir, TTL: *ttl}
+	removed, err := c.prune(*maxAge, *all)
+	if err != nil {
+		return err
+	}
+	log.Infof("Removed %d responses from the cache in %s", removed, *dir)
+	return nil
+}
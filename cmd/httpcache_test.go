@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useTestSite points the site client at a server standing in for the facility,
+// without a rate limit or a cache, until the test is over
+func useTestSite(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	url, transport, limiter, cache := schedulePageURL, siteClient.Client.Transport, siteClient.Limiter, siteClient.Cache
+	t.Cleanup(func() {
+		srv.Close()
+		schedulePageURL, siteClient.Client.Transport, siteClient.Limiter, siteClient.Cache = url, transport, limiter, cache
+	})
+	schedulePageURL = srv.URL + "/soccer-schedule.aspx"
+	siteClient.Limiter = newTokenBucket(1000, 10)
+	siteClient.Cache = nil
+	return srv
+}
+
+// schedulePostbacks serves example.xml to postbacks, counting them
+func schedulePostbacks(t *testing.T, hits *int32) http.HandlerFunc {
+	page, err := ioutil.ReadFile("example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.Write(page)
+	}
+}
+
+func TestCachedGetRevalidates(t *testing.T) {
+
+	var hits, notModified int32
+	useTestSite(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("<html>schedule</html>"))
+	})
+	siteClient.Cache = &diskCache{Dir: t.TempDir(), TTL: time.Minute}
+
+	for i := 0; i < 2; i++ {
+		resp, err := getSoccerSchedule(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "<html>schedule</html>" {
+			t.Errorf("fetch %d got %d %q", i+1, resp.StatusCode, body)
+		}
+	}
+	// The page is asked for every time, the second time only whether it changed
+	if atomic.LoadInt32(&hits) != 2 || atomic.LoadInt32(&notModified) != 1 {
+		t.Errorf("the site was asked %d times and said not modified %d times, want 2 and 1", hits, notModified)
+	}
+}
+
+func TestPostbackCacheTTL(t *testing.T) {
+
+	var hits int32
+	useTestSite(t, schedulePostbacks(t, &hits))
+	cache := &diskCache{Dir: t.TempDir(), TTL: time.Minute}
+	siteClient.Cache = cache
+
+	getTwice := func() {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			games, err := getGames(context.Background(), "4153", "733", "", ViewStateInfo{}, nil)
+			if err != nil || len(games) != 2 {
+				t.Fatalf("got %d games, %v", len(games), err)
+			}
+		}
+	}
+
+	getTwice()
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Errorf("the site was asked %d times within the TTL, want once", hits)
+	}
+	// Once the TTL has passed the site is asked again
+	cache.TTL = time.Nanosecond
+	getTwice()
+	if hits := atomic.LoadInt32(&hits); hits != 3 {
+		t.Errorf("the site was asked %d times after the TTL, want 3", hits)
+	}
+}
+
+func TestCacheOnlyWithFlag(t *testing.T) {
+
+	var hits int32
+	useTestSite(t, schedulePostbacks(t, &hits))
+
+	tests := []struct {
+		flags siteFlags
+		hits  int32
+	}{
+		{siteFlags{}, 2},
+		{siteFlags{NoCache: true}, 2},
+		{siteFlags{Cache: true, NoCache: true}, 2},
+		{siteFlags{Cache: true}, 1},
+	}
+	for _, tt := range tests {
+		tt.flags.CacheDir, tt.flags.CacheTTL = t.TempDir(), time.Minute
+		if err := tt.flags.apply(); err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&hits, 0)
+		for i := 0; i < 2; i++ {
+			if _, err := getGames(context.Background(), "4153", "733", "", ViewStateInfo{}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if hits := atomic.LoadInt32(&hits); hits != tt.hits {
+			t.Errorf("with -cache %v and -no-cache %v the site was asked %d times, want %d", tt.flags.Cache, tt.flags.NoCache, hits, tt.hits)
+		}
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+
+	c := &diskCache{Dir: t.TempDir(), TTL: 10 * time.Minute}
+	now := time.Now()
+	files := map[string]time.Time{
+		"get/fresh.json":      now.Add(-time.Hour),
+		"get/stale.json":      now.Add(-8 * 24 * time.Hour),
+		"postback/fresh.json": now.Add(-time.Minute),
+		"postback/stale.json": now.Add(-time.Hour),
+	}
+	write := func() {
+		for name, modified := range files {
+			path := filepath.Join(c.Dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte("{}"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write()
+	removed, err := c.prune(7*24*time.Hour, false)
+	if err != nil || removed != 2 {
+		t.Fatalf("pruned %d, %v, want 2", removed, err)
+	}
+	for name := range files {
+		_, err := os.Stat(filepath.Join(c.Dir, name))
+		if stale := filepath.Base(name) == "stale.json"; stale != os.IsNotExist(err) {
+			t.Errorf("%s: stale %v, got %v", name, stale, err)
+		}
+	}
+
+	write()
+	if removed, err := c.prune(7*24*time.Hour, true); err != nil || removed != 4 {
+		t.Errorf("pruned %d of everything, %v, want 4", removed, err)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gameDuration is how long a game is booked for, the grid only lists kickoff
+const gameDuration = time.Hour
+
+// timezoneMargin is how far either side of the events the transitions of the
+// time zone are described, so apps moving an event a little still have them
+const timezoneMargin = 366 * 24 * time.Hour
+
+// teamSummary describes games from the point of view of a team
+func teamSummary(teamID string) func(g game) string {
+	return func(g game) string {
+		return g.summary(teamID)
+	}
+}
+
+// writeICS writes the games of a team as an RFC 5545 calendar
+func writeICS(w io.Writer, teamName string, teamID string, games []game, now time.Time) error {
+	return writeCalendar(w, calendarName(teamName), games, teamSummary(teamID), now)
+}
+
+// calendarName is the name of the calendar holding the games of a team or division
+func calendarName(name string) string {
+	return name + " – 8 Rinks"
+}
+
+// writeCalendar writes the games as an RFC 5545 calendar, each game a VEVENT whose
+// UID comes from the game's identity key so that calendar apps update the event
+// when the game is rescheduled instead of adding another one
+func writeCalendar(w io.Writer, name string, games []game, summary func(g game) string, now time.Time) error {
+	events := make([]calendarEvent, 0, len(games))
+	for _, g := range games {
+		events = append(events, newCalendarEvent(g, summary))
+	}
+	return writeEvents(w, name, events, now)
+}
+
+// writeEvents writes the events as an RFC 5545 calendar published under name
+func writeEvents(w io.Writer, name string, events []calendarEvent, now time.Time) error {
+	return writeVCalendar(w, name, events, now, true)
+}
+
+// writeResource writes the event as a CalDAV calendar object resource, which
+// RFC 4791 doesn't allow a METHOD in. The collection it is in has the name.
+func writeResource(w io.Writer, ev calendarEvent, now time.Time) error {
+	return writeVCalendar(w, "", []calendarEvent{ev}, now, false)
+}
+
+// writeVCalendar writes a VCALENDAR holding the events, with the properties of a
+// published calendar if publish is set
+func writeVCalendar(w io.Writer, name string, events []calendarEvent, now time.Time, publish bool) error {
+
+	bw := bufio.NewWriter(w)
+	lw := &icsWriter{w: bw}
+
+	lw.line("BEGIN:VCALENDAR")
+	lw.line("VERSION:2.0")
+	lw.line("PRODID:-//johnbuonassisi//8rinks-scraper//EN")
+	lw.line("CALSCALE:GREGORIAN")
+	if publish {
+		lw.line("METHOD:PUBLISH")
+		lw.line("X-WR-CALNAME:" + icsEscape(name))
+		lw.line("X-WR-TIMEZONE:" + leagueLocation.String())
+	}
+	from, to := now, now
+	for _, ev := range events {
+		if ev.Start.Before(from) {
+			from = ev.Start
+		}
+		if ev.End.After(to) {
+			to = ev.End
+		}
+	}
+	for _, l := range icsTimezone(leagueLocation, from.Add(-timezoneMargin), to.Add(timezoneMargin)) {
+		lw.line(l)
+	}
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	for _, ev := range events {
+		status := "CONFIRMED"
+		if ev.Cancelled {
+			status = "CANCELLED"
+		}
+		lw.line("BEGIN:VEVENT")
+		lw.line("UID:" + eventName(ev) + uidSuffix)
+		lw.line("DTSTAMP:" + stamp)
+		lw.line("DTSTART;TZID=" + leagueLocation.String() + ":" + icsLocalTime(ev.Start))
+		lw.line("DTEND;TZID=" + leagueLocation.String() + ":" + icsLocalTime(ev.End))
+		lw.line(fmt.Sprintf("SEQUENCE:%d", ev.Sequence))
+		lw.line("STATUS:" + status)
+		lw.line("SUMMARY:" + icsEscape(ev.Summary))
+		if ev.Location != "" {
+			lw.line("LOCATION:" + icsEscape(ev.Location))
+		}
+		if ev.Description != "" {
+			lw.line("DESCRIPTION:" + icsEscape(ev.Description))
+		}
+		lw.line("END:VEVENT")
+	}
+	lw.line("END:VCALENDAR")
+
+	if lw.err != nil {
+		return lw.err
+	}
+	return bw.Flush()
+}
+
+// uidSuffix follows the event name in the UID of every event
+const uidSuffix = "@8rinks-scraper"
+
+// eventName is the part of the UID of an event before uidSuffix, its game key and
+// the team it was synced for if any, so that a calendar can hold an event for a
+// game for each of its teams
+func eventName(ev calendarEvent) string {
+	if ev.Team == "" {
+		return ev.Key
+	}
+	return ev.Key + "+" + ev.Team
+}
+
+// eventKey is the key of the event for a game, the game's identity key, or its
+// slot for games stored before keys were assigned
+func eventKey(g game) string {
+	if g.Key == "" {
+		return strings.Replace(g.slot(), "|", "-", -1)
+	}
+	return g.Key
+}
+
+// icsTimezone returns the VTIMEZONE of loc from one time to another, so calendar
+// apps don't need to know the zone. It is referenced by the TZID of every DTSTART
+// and DTEND. Each offset change between the times is an observance of its own.
+func icsTimezone(loc *time.Location, from, to time.Time) []string {
+
+	lines := []string{"BEGIN:VTIMEZONE", "TZID:" + loc.String()}
+	observance := func(t time.Time, offsetFrom int) {
+		kind := "STANDARD"
+		if t.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		abbr, offsetTo := t.Zone()
+		lines = append(lines,
+			"BEGIN:"+kind,
+			// The start is a local time before the change
+			"DTSTART:"+t.In(time.FixedZone("", offsetFrom)).Format("20060102T150405"),
+			"TZOFFSETFROM:"+icsOffset(offsetFrom),
+			"TZOFFSETTO:"+icsOffset(offsetTo),
+			"TZNAME:"+abbr,
+			"END:"+kind,
+		)
+	}
+
+	// The offset in effect at the start, since when it has been
+	t := from.In(loc)
+	start, end := t.ZoneBounds()
+	_, offset := t.Zone()
+	if start.IsZero() {
+		start = time.Date(1970, time.January, 1, 0, 0, 0, 0, loc)
+	}
+	observance(start.In(loc), offset)
+
+	for !end.IsZero() && end.Before(to) {
+		observance(end, offset)
+		_, offset = end.Zone()
+		_, end = end.ZoneBounds()
+	}
+	return append(lines, "END:VTIMEZONE")
+}
+
+// icsOffset formats an offset from UTC in seconds as a UTC-OFFSET value
+func icsOffset(secs int) string {
+	sign := "+"
+	if secs < 0 {
+		sign, secs = "-", -secs
+	}
+	offset := fmt.Sprintf("%s%02d%02d", sign, secs/3600, secs/60%60)
+	if secs%60 != 0 {
+		offset += fmt.Sprintf("%02d", secs%60)
+	}
+	return offset
+}
+
+// icsLocalTime formats t as a local time in the league time zone
+func icsLocalTime(t time.Time) string {
+	return t.In(leagueLocation).Format("20060102T150405")
+}
+
+// icsEscape escapes the characters that are special in iCalendar text values
+func icsEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`;`, `\;`,
+		`,`, `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// icsWriter writes content lines terminated by CRLF and folded at 75 octets,
+// without splitting a UTF-8 character, as RFC 5545 requires. The first error
+// is kept and every write after it is skipped.
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (lw *icsWriter) line(s string) {
+	if lw.err != nil {
+		return
+	}
+	var b strings.Builder
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		// Continuation lines start with a space, which counts towards the limit
+		limit = 74
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	_, lw.err = io.WriteString(lw.w, b.String())
+}
+
+// isRuneStart reports whether b is the first byte of a UTF-8 character
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// icsSink keeps an iCalendar file in step with the schedule, or writes the events
+// to a writer such as stdout. The events are held in memory and written out on
+// Flush, a file is replaced atomically. The events of every team in the file are
+// written out, not just those of the team being synced.
+type icsSink struct {
+	path   string    // file the events are read from and written to
+	w      io.Writer // written to instead when there is no path
+	name   string
+	events map[string]calendarEvent // by event name
+}
+
+// newICSFileSink returns a sink for the iCalendar file at path, which needn't exist
+func newICSFileSink(path string, name string) *icsSink {
+	return &icsSink{path: path, name: name, events: make(map[string]calendarEvent)}
+}
+
+// newICSWriterSink returns a sink that starts empty and writes every event to w
+func newICSWriterSink(w io.Writer, name string) *icsSink {
+	return &icsSink{w: w, name: name, events: make(map[string]calendarEvent)}
+}
+
+func (s *icsSink) Name() string {
+	if s.path == "" {
+		return "stdout"
+	}
+	return "ics:" + s.path
+}
+
+// List returns the team's events in the file, with their event name as their ID
+func (s *icsSink) List(ctx context.Context, teamID string) ([]calendarEvent, error) {
+
+	s.events = make(map[string]calendarEvent)
+	if s.path != "" {
+		f, err := os.Open(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error opening %s, %v", s.path, err)
+		}
+		if err == nil {
+			events, err := readEvents(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("error reading %s, %v", s.path, err)
+			}
+			for _, ev := range events {
+				ev.ID = eventName(ev)
+				s.events[ev.ID] = ev
+			}
+		}
+	}
+
+	var events []calendarEvent
+	for _, ev := range s.events {
+		if forTeam(ev, teamID) {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func (s *icsSink) Upsert(ctx context.Context, ev calendarEvent) error {
+	// The name changes when an event synced before events had teams is tagged
+	delete(s.events, ev.ID)
+	ev.ID = eventName(ev)
+	s.events[ev.ID] = ev
+	return nil
+}
+
+func (s *icsSink) Delete(ctx context.Context, ev calendarEvent) error {
+	delete(s.events, ev.ID)
+	return nil
+}
+
+// Flush writes every event, sorted by start time
+func (s *icsSink) Flush(ctx context.Context) error {
+
+	events := make([]calendarEvent, 0, len(s.events))
+	for _, ev := range s.events {
+		events = append(events, ev)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Start.Equal(events[j].Start) {
+			return events[i].Start.Before(events[j].Start)
+		}
+		return events[i].ID < events[j].ID
+	})
+
+	if s.path == "" {
+		return writeEvents(s.w, s.name, events, time.Now())
+	}
+	var buf bytes.Buffer
+	if err := writeEvents(&buf, s.name, events, time.Now()); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, buf.Bytes(), 0644)
+}
+
+// readEvents reads the VEVENTs of an iCalendar file written by writeEvents. Only
+// the properties writeEvents writes are read back, and events whose UID wasn't
+// made by the scraper are skipped.
+func readEvents(r io.Reader) ([]calendarEvent, error) {
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(l, " ") && len(lines) > 0 {
+			// Unfold continuation lines
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		lines = append(lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []calendarEvent
+	var ev *calendarEvent
+	for _, l := range lines {
+		i := strings.Index(l, ":")
+		if i < 0 {
+			continue
+		}
+		name, value := l[:i], l[i+1:]
+		param := ""
+		if j := strings.Index(name, ";"); j >= 0 {
+			name, param = name[:j], name[j+1:]
+		}
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			ev = &calendarEvent{}
+		case ev == nil:
+			continue
+		case name == "END" && value == "VEVENT":
+			if strings.HasSuffix(ev.Key, uidSuffix) {
+				ev.Key = strings.TrimSuffix(ev.Key, uidSuffix)
+				if i := strings.LastIndex(ev.Key, "+"); i >= 0 {
+					ev.Key, ev.Team = ev.Key[:i], ev.Key[i+1:]
+				}
+				events = append(events, *ev)
+			}
+			ev = nil
+		case name == "UID":
+			ev.Key = value
+		case name == "SUMMARY":
+			ev.Summary = icsUnescape(value)
+		case name == "LOCATION":
+			ev.Location = icsUnescape(value)
+		case name == "DESCRIPTION":
+			ev.Description = icsUnescape(value)
+		case name == "STATUS":
+			ev.Cancelled = value == "CANCELLED"
+		case name == "SEQUENCE":
+			ev.Sequence, _ = strconv.Atoi(value)
+		case name == "DTSTART" || name == "DTEND":
+			t, err := icsParseTime(param, value)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing %s of %s, %v", name, ev.Key, err)
+			}
+			if name == "DTSTART" {
+				ev.Start = t
+			} else {
+				ev.End = t
+			}
+		}
+	}
+	return events, nil
+}
+
+// icsParseTime parses a DATE-TIME value, in UTC or in the zone named by its TZID
+func icsParseTime(param string, value string) (time.Time, error) {
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse("20060102T150405Z", value)
+	}
+	loc := leagueLocation
+	if strings.HasPrefix(param, "TZID=") {
+		var err error
+		if loc, err = time.LoadLocation(strings.TrimPrefix(param, "TZID=")); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.ParseInLocation("20060102T150405", value, loc)
+}
+
+// icsUnescape reverses icsEscape
+func icsUnescape(s string) string {
+	return strings.NewReplacer(
+		`\\`, `\`,
+		`\;`, `;`,
+		`\,`, `,`,
+		`\n`, "\n",
+		`\N`, "\n",
+	).Replace(s)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteEventsRoundTrip(t *testing.T) {
+
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	want := []calendarEvent{
+		{
+			Key:      "733-483-4150-4153-1",
+			Summary:  "Megpies FC vs Degenerates FC (Home)",
+			Location: "Burnaby Indoor Soccer Centre",
+			Start:    kickoff,
+			End:      kickoff.Add(gameDuration),
+		},
+		{
+			Key:         "733-483-4152-4153-1",
+			Summary:     "Megpies FC vs Croatia U21; rescheduled, again – the league’s long summary that needs folding",
+			Location:    "Field 2, Burnaby\nUpstairs",
+			Description: `Megpies FC 1 - 3 Croatia U21 \ final`,
+			Start:       kickoff.AddDate(0, 3, 0),
+			End:         kickoff.AddDate(0, 3, 0).Add(gameDuration),
+			Sequence:    2,
+			Cancelled:   true,
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeEvents(&buf, calendarName("Megpies FC"), want, kickoff); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		if len(l) > 75 {
+			t.Errorf("line longer than 75 octets: %q", l)
+		}
+	}
+
+	got, err := readEvents(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Start.Equal(want[i].Start) || !got[i].End.Equal(want[i].End) {
+			t.Errorf("event %d from %v to %v, want %v to %v", i, got[i].Start, got[i].End, want[i].Start, want[i].End)
+		}
+		got[i].Start, got[i].End = want[i].Start, want[i].End
+		if got[i] != want[i] {
+			t.Errorf("event %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReadEventsSkipsForeignEvents(t *testing.T) {
+
+	cal := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"UID:someone-else@example.com",
+		"DTSTART:20190912T020000Z",
+		"SUMMARY:Dentist",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:733-483-4150-4153-1@8rinks-scraper",
+		"DTSTART:20190913T020000Z",
+		"SUMMARY:Megpies FC vs Degenerates FC (Home)",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	events, err := readEvents(strings.NewReader(cal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Key != "733-483-4150-4153-1" {
+		t.Fatalf("got events %+v, want only the scraper's", events)
+	}
+	if want := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation); !events[0].Start.Equal(want) {
+		t.Errorf("start %v, want %v", events[0].Start, want)
+	}
+}
+
+func TestICSTimezone(t *testing.T) {
+
+	vancouver, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(icsTimezone(vancouver,
+		time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2019, time.December, 31, 0, 0, 0, 0, time.UTC)), "\n")
+	want := strings.Join([]string{
+		"BEGIN:VTIMEZONE",
+		"TZID:America/Vancouver",
+		"BEGIN:STANDARD",
+		"DTSTART:20181104T010000",
+		"TZOFFSETFROM:-0800",
+		"TZOFFSETTO:-0800",
+		"TZNAME:PST",
+		"END:STANDARD",
+		"BEGIN:DAYLIGHT",
+		"DTSTART:20190310T020000",
+		"TZOFFSETFROM:-0800",
+		"TZOFFSETTO:-0700",
+		"TZNAME:PDT",
+		"END:DAYLIGHT",
+		"BEGIN:STANDARD",
+		"DTSTART:20191103T020000",
+		"TZOFFSETFROM:-0700",
+		"TZOFFSETTO:-0800",
+		"TZNAME:PST",
+		"END:STANDARD",
+		"END:VTIMEZONE",
+	}, "\n")
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// A zone of the southern hemisphere, and one that never changes
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = strings.Join(icsTimezone(sydney,
+		time.Date(2019, time.June, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2019, time.December, 1, 0, 0, 0, 0, time.UTC)), "\n")
+	if !strings.Contains(got, "BEGIN:DAYLIGHT\nDTSTART:20191006T020000\nTZOFFSETFROM:+1000\nTZOFFSETTO:+1100\n") {
+		t.Errorf("no change to daylight time in\n%s", got)
+	}
+	got = strings.Join(icsTimezone(time.UTC, time.Now(), time.Now().Add(timezoneMargin)), "\n")
+	if want := "BEGIN:VTIMEZONE\nTZID:UTC\nBEGIN:STANDARD\nDTSTART:19700101T000000\nTZOFFSETFROM:+0000\nTZOFFSETTO:+0000\nTZNAME:UTC\nEND:STANDARD\nEND:VTIMEZONE"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The gvFuture grid has no game ID, so a fixture is identified by its season,
+// division, the two teams playing and which of their meetings this season it is.
+// A key looks like 733-483-4150-4153-2, the second game between teams 4150 and
+// 4153 in division 483 of season 733. The lower team ID always comes first so
+// the key doesn't depend on who is home.
+//
+// The key stays the same when a game is moved to a different time, day or
+// location, which lets change detection and calendar sync treat it as the same
+// fixture. A key is never given to another game once it has been used, not even
+// when its game is cancelled. When two meetings of the same teams are moved, or
+// one is moved and another cancelled, in between scrapes they can't be told
+// apart and the earlier key goes to the earlier game.
+
+// gamePair identifies the two teams of a fixture within a division
+type gamePair struct {
+	SeasonID   string
+	DivisionID string
+	LowTeamID  string
+	HighTeamID string
+}
+
+// pair returns the two teams of the game, lower team ID first
+func (g game) pair() gamePair {
+	p := gamePair{
+		SeasonID:   g.SeasonID,
+		DivisionID: g.DivisionID,
+		LowTeamID:  g.VisitingTeamID,
+		HighTeamID: g.HomeTeamID,
+	}
+	if teamIDLess(p.HighTeamID, p.LowTeamID) {
+		p.LowTeamID, p.HighTeamID = p.HighTeamID, p.LowTeamID
+	}
+	return p
+}
+
+// gameKey formats the identity key of the nth meeting of a pair, counting from 1
+func gameKey(p gamePair, n int) string {
+	return fmt.Sprintf("%s-%s-%s-%s-%d", p.SeasonID, p.DivisionID, p.LowTeamID, p.HighTeamID, n)
+}
+
+// assignGameKeys sets the identity key of each game from the stored games of the
+// season, cancelled ones included. A game still listed where a stored game was
+// keeps its key, a game listed somewhere new takes the key of a stored meeting
+// of the same teams that is no longer listed where it was, and any other game is
+// a new meeting numbered after every meeting stored so far.
+func assignGameKeys(stored []game, games []game, now time.Time) {
+
+	listed := make(map[string]bool)
+	for _, g := range games {
+		listed[g.slot()] = true
+	}
+
+	keys := make(map[string]string)      // stored keys by slot
+	used := make(map[gamePair]int)       // the highest ordinal stored for the pair
+	unkeyed := make(map[gamePair]int)    // games played before games had keys
+	unlisted := make(map[gamePair][]int) // ordinals of upcoming games no longer at their slot
+	for _, g := range stored {
+		p := g.pair()
+		if g.Key == "" {
+			if g.StartTime.Before(now) && !listed[g.slot()] {
+				unkeyed[p]++
+			}
+			continue
+		}
+		n := keyOrdinal(g.Key)
+		if n > used[p] {
+			used[p] = n
+		}
+		switch {
+		case listed[g.slot()]:
+			keys[g.slot()] = g.Key
+		case !g.Cancelled && !g.StartTime.Before(now):
+			unlisted[p] = append(unlisted[p], n)
+		}
+	}
+	for p, n := range unkeyed {
+		if n > used[p] {
+			used[p] = n
+		}
+	}
+	for _, ordinals := range unlisted {
+		sort.Ints(ordinals)
+	}
+
+	order := make([]int, len(games))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return games[order[i]].StartTime.Before(games[order[j]].StartTime)
+	})
+
+	for _, i := range order {
+		if key, ok := keys[games[i].slot()]; ok {
+			games[i].Key = key
+			continue
+		}
+		p := games[i].pair()
+		if ordinals := unlisted[p]; len(ordinals) > 0 {
+			games[i].Key = gameKey(p, ordinals[0])
+			unlisted[p] = ordinals[1:]
+			continue
+		}
+		used[p]++
+		games[i].Key = gameKey(p, used[p])
+	}
+}
+
+// keyOrdinal returns which meeting of its two teams a key is for
+func keyOrdinal(key string) int {
+	n, _ := strconv.Atoi(key[strings.LastIndex(key, "-")+1:])
+	return n
+}
+
+// slot identifies a game by when it is played and who is playing
+func (g game) slot() string {
+	return fmt.Sprintf("%s|%s|%s", g.StartTime.UTC().Format(time.RFC3339), g.VisitingTeamID, g.HomeTeamID)
+}
+
+// teamIDLess orders team IDs numerically when they are numbers, so 999 comes
+// before 1000
+func teamIDLess(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// gameKeys returns the key of each game, in order
+func gameKeys(games []game) []string {
+	var keys []string
+	for _, g := range games {
+		keys = append(keys, g.Key)
+	}
+	return keys
+}
+
+func TestAssignGameKeys(t *testing.T) {
+
+	now := time.Date(2019, time.September, 15, 12, 0, 0, 0, leagueLocation)
+	first := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	second := first.AddDate(0, 0, 7)
+	third := second.AddDate(0, 0, 7)
+
+	stored := []game{
+		testGame(first, "4150", "4153"),
+		testGame(second, "4153", "4150"),
+		testGame(third, "4150", "4153"),
+	}
+	assignGameKeys(nil, stored, now)
+	want := []string{"733-483-4150-4153-1", "733-483-4150-4153-2", "733-483-4150-4153-3"}
+	for i, key := range gameKeys(stored) {
+		if key != want[i] {
+			t.Fatalf("got keys %v, want %v", gameKeys(stored), want)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		games []game
+		want  []string
+	}{
+		{
+			name:  "played game dropped from the grid",
+			games: []game{testGame(second, "4153", "4150"), testGame(third, "4150", "4153")},
+			want:  []string{"733-483-4150-4153-2", "733-483-4150-4153-3"},
+		},
+		{
+			name:  "earlier meeting cancelled",
+			games: []game{testGame(third, "4150", "4153")},
+			want:  []string{"733-483-4150-4153-3"},
+		},
+		{
+			name:  "moved past a later meeting",
+			games: []game{testGame(third, "4150", "4153"), testGame(third.AddDate(0, 0, 7), "4153", "4150")},
+			want:  []string{"733-483-4150-4153-3", "733-483-4150-4153-2"},
+		},
+		{
+			name:  "new meeting",
+			games: []game{testGame(second, "4153", "4150"), testGame(third, "4150", "4153"), testGame(third.AddDate(0, 0, 7), "4150", "4153")},
+			want:  []string{"733-483-4150-4153-2", "733-483-4150-4153-3", "733-483-4150-4153-4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assignGameKeys(stored, tt.games, now)
+			got := gameKeys(tt.games)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got keys %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got keys %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCancelledMeetingKeepsKeys(t *testing.T) {
+
+	store := openTestStore(t)
+	now := time.Date(2019, time.September, 1, 12, 0, 0, 0, leagueLocation)
+	first := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	second := first.AddDate(0, 0, 7)
+
+	saveScrape(t, store, "4153", []game{
+		testGame(first, "4150", "4153"),
+		testGame(second, "4153", "4150"),
+	}, now)
+
+	// The first meeting is cancelled, the second must not take its key
+	changes := saveScrape(t, store, "4153", []game{testGame(second, "4153", "4150")}, now)
+	if len(changes) != 1 || changes[0].Type != changeRemoved || changes[0].Before.Key != "733-483-4150-4153-1" {
+		t.Fatalf("got changes %v, want the first meeting removed", changes)
+	}
+
+	// Scraping the same schedule again finds nothing, and a new meeting gets a
+	// key of its own
+	if changes := saveScrape(t, store, "4153", []game{testGame(second, "4153", "4150")}, now); len(changes) != 0 {
+		t.Fatalf("got changes %v on an unchanged schedule", changes)
+	}
+	third := testGame(second.AddDate(0, 0, 7), "4150", "4153")
+	changes = saveScrape(t, store, "4153", []game{testGame(second, "4153", "4150"), third}, now)
+	if len(changes) != 1 || changes[0].Type != changeAdded || changes[0].After.Key != "733-483-4150-4153-3" {
+		t.Fatalf("got changes %v, want the third meeting added", changes)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// acquireLock creates the file at path, failing if it exists, so only one process
+// runs at a time. The file is removed by the returned function. A process that
+// dies leaves it behind, and it has to be removed by hand.
+func acquireLock(path string) (release func(), err error) {
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("another process holds the lock %s, remove it if it doesn't", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating lock file, %v", err)
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+
+	return func() {
+		os.Remove(path)
+	}, nil
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -11,28 +14,233 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	_ "time/tzdata" // the league time zone must load on machines without zoneinfo
+	"unicode"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/html"
 )
 
+// leagueLocation is the time zone the facility publishes its schedule in
+var leagueLocation *time.Location
+
 func init() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetLevel(log.InfoLevel)
+
+	var err error
+	leagueLocation, err = time.LoadLocation(defaultTimeZone)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// commands are run by naming them as the first argument, without one the
+// schedule of a team is scraped
+var commands = map[string]func(args []string) error{
+	"cache":     cacheCommand,
+	"daemon":    daemonCommand,
+	"digest":    digestCommand,
+	"doctor":    doctorCommand,
+	"init":      initCommand,
+	"selfcheck": doctorCommand,
+	"serve":     serveCommand,
+	"sync":      syncCommand,
 }
 
 func main() {
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	var configPath = flag.String("config", "", configUsage)
 	var teamName = flag.String("tn", "Megpies FC", "Team name for which the schedule will be retrieved")
+	var dbPath = flag.String("db", "8rinks.db", "Path to the SQLite database the schedule is stored in")
+	var format = flag.String("format", "text", "Output format, text, json or ics")
+	var webhooks stringList
+	flag.Var(&webhooks, "webhook", "URL to post schedule changes to, may be repeated")
+	var webhookTemplate = flag.String("webhook-template", "", "Path to a text/template file the webhook payload is rendered from")
+	var deadLetter = flag.String("dead-letter", "webhooks.dead.jsonl", "Path of the log webhook posts that could not be delivered are appended to")
+	var site siteFlags
+	site.register(flag.CommandLine)
 	flag.Parse()
 
-	// First, navigate to the soccer schedule page
-	resp, err := getSoccerSchedule()
+	if _, err := configure(flag.CommandLine, *configPath); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if err := site.apply(); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	var notifier *webhookNotifier
+	if len(webhooks) > 0 {
+		var err error
+		notifier, err = newWebhookNotifier(webhooks, *webhookTemplate, *deadLetter)
+		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	store, err := OpenStore(*dbPath)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	result, changes, err := scrapeAndSave(context.Background(), store, teamRef{Name: *teamName})
 	if err != nil {
 		log.Errorf("%v", err)
+		store.Close()
 		os.Exit(1)
 	}
 
+	if notifier != nil && len(changes) > 0 {
+		err := notifier.Notify(notification{
+			TeamID:   result.TeamID,
+			TeamName: result.TeamName,
+			Changes:  changes,
+			Games:    result.Games,
+		})
+		if err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+
+	switch *format {
+	case "ics":
+		// The calendar is rendered from the store so that cancelled games and
+		// sequence numbers are included
+		games, err := store.CalendarGames(result.SeasonID, result.TeamID)
+		if err == nil {
+			err = writeICS(os.Stdout, result.TeamName, result.TeamID, games, time.Now())
+		}
+		if err != nil {
+			log.Errorf("%v", err)
+		}
+	case "json":
+		out := struct {
+			Games   []game   `json:"games"`
+			Changes []change `json:"changes"`
+		}{result.Games, changes}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			log.Errorf("%v", err)
+		}
+	default:
+		for _, g := range result.Games {
+			log.Infof("game: %+v", g)
+		}
+		if len(changes) == 0 {
+			fmt.Println("No schedule changes")
+		}
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+	}
+
+}
+
+// scrapeAndSave scrapes the team's schedule, compares it with the stored one and
+// saves both the schedule and the changes found. The run and its outcome are
+// recorded in the store.
+func scrapeAndSave(ctx context.Context, store *Store, ref teamRef) (scrapeResult, []change, error) {
+
+	runID, err := store.StartRun(ref.String())
+	if err != nil {
+		return scrapeResult{TeamName: ref.Name, TeamID: ref.ID}, nil, err
+	}
+
+	result, changes, err := scrapeAndCompare(ctx, store, runID, ref)
+	result.RunID = runID
+	if finishErr := store.FinishRun(runID, result, changes, err); finishErr != nil {
+		log.Errorf("%v", finishErr)
+	}
+	return result, changes, err
+}
+
+func scrapeAndCompare(ctx context.Context, store *Store, runID int64, ref teamRef) (scrapeResult, []change, error) {
+
+	result, err := scrapeTeam(ctx, ref)
+	if err != nil {
+		return result, nil, err
+	}
+
+	stored, err := store.CalendarGames(result.SeasonID, result.TeamID)
+	if err != nil {
+		return result, nil, err
+	}
+	prev, err := store.Games(result.SeasonID, result.TeamID)
+	if err != nil {
+		return result, nil, err
+	}
+	now := time.Now()
+	assignGameKeys(stored, result.Games, now)
+	changes := detectChanges(result.TeamID, prev, result.Games, now)
+
+	if err := store.SaveSchedule(runID, result, changes); err != nil {
+		return result, nil, err
+	}
+	return result, changes, nil
+}
+
+// scrapeResult is everything a single scrape of the schedule page finds for a team
+type scrapeResult struct {
+	RunID    int64 // the scrape run that found the games, once they are saved
+	SeasonID string
+	TeamID   string
+	TeamName string
+	Games    []game
+}
+
+// teamRef is a team to scrape, by name or by the ID the site gives it, and the
+// division it plays in if the schedule should be narrowed to it
+type teamRef struct {
+	Name     string
+	ID       string
+	Division string
+}
+
+// String is how the team is referred to in logs and scrape runs
+func (r teamRef) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return "team " + r.ID
+}
+
+// key identifies the scrape of the team, references to the same team by name and
+// by ID aren't known to be the same until it is scraped
+func (r teamRef) key() string {
+	if r.ID != "" {
+		return "id " + r.ID + " division " + r.Division
+	}
+	return "name " + r.Name + " division " + r.Division
+}
+
+// scrapeTeam navigates the soccer schedule page the same way a browser would
+// and returns the current season's games for the team
+func scrapeTeam(ctx context.Context, ref teamRef) (result scrapeResult, err error) {
+
+	result.TeamName = ref.Name
+
+	// First, navigate to the soccer schedule page
+	resp, err := getSoccerSchedule(ctx)
+	if err != nil {
+		return result, err
+	}
+
 	// Read all of the response body and store in memory. Each processing function
 	// should make a new io.ReadCloser of the response body to start at the beginning
 	// of the response.
@@ -41,54 +249,157 @@ func main() {
 
 	// Then, find the current season the league is in
 	resp.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes)) // reset response body
-	seasonID, err := getSeasonID(resp)
+	result.SeasonID, err = getSeasonID(resp)
 	if err != nil {
-		log.Errorf("%v", err)
-		os.Exit(1)
+		return result, err
 	}
 	resp.Body.Close()
-	log.Infof("Season ID: %s", seasonID)
-
-	// Next, find the provided team in the dropdown
-	resp.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes)) // reset response body
-	teamID, err := getTeamID(*teamName, resp)
-	if err != nil {
-		log.Errorf("%v", err)
-		os.Exit(1)
+	log.Infof("Season ID: %s", result.SeasonID)
+
+	// Next, find the provided team in the dropdown, or its name if the ID is known
+	if ref.ID != "" {
+		result.TeamID = ref.ID
+		if result.TeamName == "" {
+			result.TeamName, err = getTeamName(ref.ID, bodyBytes)
+			if err != nil {
+				return result, err
+			}
+		}
+	} else {
+		resp.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes)) // reset response body
+		result.TeamID, err = getTeamID(ref.Name, resp)
+		if err != nil {
+			return result, err
+		}
+		resp.Body.Close()
 	}
-	resp.Body.Close()
-	log.Infof("Team Name: %s", *teamName)
-	log.Infof("Team ID: %s", teamID)
+	log.Infof("Team Name: %s", result.TeamName)
+	log.Infof("Team ID: %s", result.TeamID)
 
 	// Extract the __VIEWSTATES from the original response
 	resp.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes)) // reset response body
 	viewStateInfo, err := getViewStates(resp)
 	if err != nil {
-		log.Errorf("%v", err)
-		os.Exit(1)
+		return result, err
 	}
 
 	// Finally, press the Go button to get the team's games
 	resp.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes)) // reset response body
-	games, err := getGames(teamID, seasonID, viewStateInfo, resp.Cookies())
+	result.Games, err = getGames(ctx, result.TeamID, result.SeasonID, ref.Division, viewStateInfo, resp.Cookies())
 	if err != nil {
-		log.Errorf("%v", err)
-		os.Exit(1)
+		return result, err
 	}
 
-	for _, g := range games {
-		log.Infof("game: %+v", g)
+	return result, nil
+}
+
+// game is a single row of the gvFuture grid. Team IDs are taken from the `tid`
+// query parameter of the team links, and the division from `did`. Key is the
+// identity of the fixture, see assignGameKeys.
+type game struct {
+	Key            string    `json:"key"`
+	SeasonID       string    `json:"season_id"`
+	DivisionID     string    `json:"division_id"`
+	StartTime      time.Time `json:"start_time"`
+	VisitingTeamID string    `json:"visiting_team_id"`
+	VisitingTeam   string    `json:"visiting_team"`
+	VisitingScore  string    `json:"visiting_score,omitempty"`
+	HomeTeamID     string    `json:"home_team_id"`
+	HomeTeam       string    `json:"home_team"`
+	HomeScore      string    `json:"home_score,omitempty"`
+	Event          string    `json:"event"`
+	Location       string    `json:"location"`
+	Cancelled      bool      `json:"cancelled,omitempty"`
+	Sequence       int       `json:"sequence,omitempty"` // bumped every time the game is rescheduled
+}
+
+// isHome reports whether the given team is the home team of the game
+func (g game) isHome(teamID string) bool {
+	return g.HomeTeamID == teamID
+}
+
+// homeAway returns Home if the given team is the home team, and Away otherwise
+func (g game) homeAway(teamID string) string {
+	if g.isHome(teamID) {
+		return "Home"
 	}
+	return "Away"
+}
 
+// teamName returns the name of the given team as it appears in the game
+func (g game) teamName(teamID string) string {
+	if g.isHome(teamID) {
+		return g.HomeTeam
+	}
+	return g.VisitingTeam
 }
 
-type game struct {
-	StartTime time.Time
-	Opponent  string
-	Location  string
+// summary describes the game from the point of view of the given team, for example
+// Megpies FC vs Croatia U21 (Away)
+func (g game) summary(teamID string) string {
+	return fmt.Sprintf("%s vs %s (%s)", g.teamName(teamID), g.opponent(teamID), g.homeAway(teamID))
 }
 
-func getGames(teamID string, seasonID string, viewStateInfo ViewStateInfo, cookies []*http.Cookie) ([]game, error) {
+// opponent returns the name of the team the given team is playing against
+func (g game) opponent(teamID string) string {
+	if g.isHome(teamID) {
+		return g.VisitingTeam
+	}
+	return g.HomeTeam
+}
+
+// getGames presses the Go button for the team's games in the season, narrowed to
+// the division unless it is empty
+func getGames(ctx context.Context, teamID string, seasonID string, divisionID string, viewStateInfo ViewStateInfo, cookies []*http.Cookie) ([]game, error) {
+
+	if divisionID == "" {
+		divisionID = "0"
+	}
+	req, err := newSchedulePostback(teamID, seasonID, divisionID, viewStateInfo, cookies)
+	if err != nil {
+		return nil, err
+	}
+
+	// The response depends only on what is asked for, not the view states, so a
+	// recent one for the same team and season can stand in for it
+	cache := siteClient.Cache
+	key := postbackKey{Season: seasonID, Division: divisionID, Team: teamID}
+	if cache != nil {
+		if cached := cache.loadPostback(key); cached != nil {
+			log.Debugf("getGames: using the cached schedule of team %s from %v", teamID, cached.StoredAt.Format(time.RFC3339))
+			return getAllGames(cached.response(req, nil), seasonID)
+		}
+	}
+
+	// Send the POST request
+	resp, err := siteClient.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if cache == nil {
+		return getAllGames(resp, seasonID)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	games, err := getAllGames(resp, seasonID)
+	if err != nil {
+		return nil, err
+	}
+	// An error page parses to no games, so only a response with games is kept
+	if len(games) > 0 {
+		cache.storePostback(key, schedulePageURL, resp, body)
+	}
+	return games, nil
+}
+
+// newSchedulePostback returns the request the Go button of the schedule page
+// sends for the team's games in the season and division, 0 for every division
+func newSchedulePostback(teamID string, seasonID string, divisionID string, viewStateInfo ViewStateInfo, cookies []*http.Cookie) (*http.Request, error) {
 
 	// Create the form
 	form := url.Values{}
@@ -98,7 +409,7 @@ func getGames(teamID string, seasonID string, viewStateInfo ViewStateInfo, cooki
 	form.Add("ctl00$mainContent$ctl01$ddlTeams", "0")
 	form.Add("ctl00$mainContent$ctl01$ddlTeams_f", teamID)
 	form.Add("ctl00$mainContent$ctl01$ddlDivisions", "0")
-	form.Add("ctl00$mainContent$ctl01$ddlDivisions_f", "0")
+	form.Add("ctl00$mainContent$ctl01$ddlDivisions_f", divisionID)
 	form.Add("__EVENTTARGET", "ctl00$mainContent$ctl01$btnGoF")
 	form.Add("__VIEWSTATEGENERATOR", viewStateInfo.ViewStateGenerator)
 	form.Add("__ASYNCPOST", "true")
@@ -116,158 +427,164 @@ func getGames(teamID string, seasonID string, viewStateInfo ViewStateInfo, cooki
 	}
 	form.Add("__EVENTVALIDATION", viewStateInfo.EventValidation)
 
-	// Create the POST request
-	req, err := http.NewRequest("POST",
-		"https://canlanaisl.icesports.com/BURNABY8RINKS/soccer-schedule.aspx",
-		strings.NewReader(form.Encode()))
+	// Create the POST request, the way the page's Go button sends it as an
+	// ASP.NET AJAX partial postback
+	req, err := newSiteRequest("POST", schedulePageURL, form)
 	if err != nil {
 		return nil, err
 	}
-
-	// Set the Header with standard fields
 	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Accept-Encoding", "gzip, deflate")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Content-Length", "42586")
-	req.Header.Set("Pragma", "no-cache")
-	req.Header.Set("Server", "Microsoft-IIS/8.5")
-	req.Header.Set("X-AspNet-Version", "4.0.30319")
-	req.Header.Set("X-Powered-By", "ASP.NET")
-	req.Header.Set("Date", time.Now().String())
-	req.Header.Set("Expires", "-1")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
-	req.Header.Set("Host", "canlanaisl.icesports.com")
-	req.Header.Set("Origin", "https://canlanaisl.icesports.com")
-	req.Header.Set("Referer", "https://canlanaisl.icesports.com/BURNABY8RINKS/soccer-schedule.aspx")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/75.0.3770.142 Safari/537.36")
+	req.Header.Set("Origin", req.URL.Scheme+"://"+req.URL.Host)
+	req.Header.Set("Referer", schedulePageURL)
 	req.Header.Set("X-MicrosoftAjax", "Delta=true")
 	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	// The postback only reads the schedule, so it is safe to retry
+	req.Header["Idempotency-Key"] = nil
 
 	for _, cookie := range cookies {
 		req.AddCookie(cookie)
 	}
-
-	// Send the POST request
-	client := http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	/*
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-
-		log.Debugf("Response to post: %s", string(bodyBytes))
-
-		s := string(bodyBytes)
-
-		// Find the dates in order
-		dateIdxs := findDaysOfWeek(s)
-		var dateStrs []string
-		for _, dateIdx := range dateIdxs {
-			dateEndIdx := strings.Index(s[dateIdx:], "<")
-			dateStr := s[dateIdx : dateIdx+dateEndIdx]
-			dateStrs = append(dateStrs, dateStr)
-		}
-
-		// Find the times in order
-		timeIdxs := findTime(s, dateIdxs)
-		var timeStrs []string
-		for _, timeIdx := range timeIdxs {
-			timeStr := s[timeIdx-6 : timeIdx+2]
-			timeStrs = append(timeStrs, timeStr)
-		}
-
-		// Parse dates and times to time.Time
-		var games []game
-		/*
-			timeLayout := "Monday, January 2, 2006, 03:04 PM MST"
-			for i, dateStr := range dateStrs {
-				dateTimeStr := dateStr + ", " + timeStrs[i] + " PST"
-				t, err := time.Parse(timeLayout, dateTimeStr)
-				if err != nil {
-					return nil, fmt.Errorf("error parsing times, %d, %v", i, err)
-				}
-				games = append(games, game{StartTime: t})
-			}
-	*/
-	games := getAllGames(resp)
-
-	return games, nil
+	return req, nil
 }
 
-func getAllGames(resp *http.Response) []game {
+// getAllGames parses the gvFuture grid in the response to the Go button. Each game
+// is preceded by a row holding only its date, the game rows themselves have the
+// columns below.
+//
+//	TIME | VISITING TEAM | SCORE | HOME TEAM | SCORE | EVENT | LOCATION
+func getAllGames(resp *http.Response, seasonID string) ([]game, error) {
+
+	log.Debug("getAllGames: trying to find games")
 
 	var games []game
+	var inGrid bool
+	var date string
+	var cells []gridCell
 	z := html.NewTokenizer(resp.Body)
 	for {
 		tt := z.Next()
 		switch tt {
 		case html.ErrorToken:
-			log.Info("error token")
-			return nil
+			if z.Err() == io.EOF {
+				return games, nil
+			}
+			return nil, z.Err()
 		case html.StartTagToken:
 			name, hasAttr := z.TagName()
-			if string(name) == "td" && hasAttr {
-				key, _, _ := z.TagAttr()
-				if string(key) == "colspan" {
-					log.Infof("Found colspan")
-					for {
-						tk := z.Next()
-						if tk == html.TextToken {
-							text := z.Text()
-							timeLayout := "  Monday, January 2, 2006, 03:04 PM MST"
-							dateTimeStr := dateStr + ", " + timeStrs[i] + " PST"
-								t, err := time.Parse(timeLayout, dateTimeStr)
-								if err != nil {
-									fmt.Printf("ERROR parsing times, %d, %v \n", i, err)
-									return
-								}
-								fmt.Printf("time: %v \n", t)
-
-							for i, dateStr := range dateStrs {
-								dateTimeStr := dateStr + ", " + timeStrs[i] + " PST"
-								t, err := time.Parse(timeLayout, dateTimeStr)
-								if err != nil {
-									fmt.Printf("ERROR parsing times, %d, %v \n", i, err)
-									return
-								}
-								fmt.Printf("time: %v \n", t)
-							}
-							log.Infof("game date: %s", text)
-							break
-						}
+			switch string(name) {
+			case "table":
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) == "id" && strings.HasSuffix(string(val), "gvFuture") {
+						log.Debug("getAllGames: found gvFuture")
+						inGrid = true
+					}
+				}
+			case "tr":
+				cells = nil
+			case "td":
+				if !inGrid {
+					continue
+				}
+				cells = append(cells, gridCell{})
+			case "a":
+				if !inGrid || len(cells) == 0 {
+					continue
+				}
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) == "href" {
+						cells[len(cells)-1].Href = string(val)
+					}
+				}
+			}
+		case html.TextToken:
+			if inGrid && len(cells) > 0 {
+				cells[len(cells)-1].Text += string(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "table":
+				if inGrid {
+					log.Debugf("getAllGames: found %d games", len(games))
+					return games, nil
+				}
+			case "tr":
+				if !inGrid {
+					continue
+				}
+				switch len(cells) {
+				case 1:
+					// A row with a single colspan cell holds the date of the games below it
+					date = cells[0].text()
+				case 7:
+					g, err := parseGameRow(seasonID, date, cells)
+					if err != nil {
+						return nil, err
 					}
+					games = append(games, g)
 				}
+				cells = nil
 			}
 		}
 	}
-	return games
 }
 
-func getSoccerSchedule() (*http.Response, error) {
+// gridCell is the content of a single td in the gvFuture grid
+type gridCell struct {
+	Text string
+	Href string
+}
+
+// text returns the cell text without the surrounding whitespace and &nbsp; padding
+func (c gridCell) text() string {
+	return strings.TrimFunc(c.Text, unicode.IsSpace)
+}
 
-	req, err := http.NewRequest("GET", "https://canlanaisl.icesports.com/BURNABY8RINKS/soccer-schedule.aspx", nil)
+// query returns the value of key in the query string of the cell's link
+func (c gridCell) query(key string) string {
+	u, err := url.Parse(c.Href)
 	if err != nil {
-		return nil, err
+		return ""
 	}
+	return u.Query().Get(key)
+}
 
-	req.Header.Set("Host", "canlanaisl.icesports.com")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/75.0.3770.142 Safari/537.36")
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3")
-	req.Header.Set("Accept-Encoding", "gzip, deflate")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+// parseGameRow builds a game from the seven cells of a gvFuture game row
+func parseGameRow(seasonID string, date string, cells []gridCell) (game, error) {
 
-	client := http.Client{}
-	resp, err := client.Do(req)
+	timeLayout := "Monday, January 2, 2006 03:04 PM"
+	dateTimeStr := date + " " + cells[0].text()
+	t, err := time.ParseInLocation(timeLayout, dateTimeStr, leagueLocation)
 	if err != nil {
-		return resp, err
+		return game{}, fmt.Errorf("error parsing game time %q, %v", dateTimeStr, err)
 	}
 
-	return resp, nil
+	return game{
+		SeasonID:       seasonID,
+		DivisionID:     cells[1].query("did"),
+		StartTime:      t,
+		VisitingTeamID: cells[1].query("tid"),
+		VisitingTeam:   cells[1].text(),
+		VisitingScore:  cells[2].text(),
+		HomeTeamID:     cells[3].query("tid"),
+		HomeTeam:       cells[3].text(),
+		HomeScore:      cells[4].text(),
+		Event:          cells[5].text(),
+		Location:       cells[6].text(),
+	}, nil
+}
+
+func getSoccerSchedule(ctx context.Context) (*http.Response, error) {
+
+	req, err := newSiteRequest("GET", schedulePageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return siteClient.Do(ctx, req)
 }
 
 type ViewStateInfo struct {
@@ -360,7 +677,10 @@ func getSeasonID(scheduleResp *http.Response) (string, error) {
 		tt := z.Next()
 		switch tt {
 		case html.ErrorToken:
-			log.Fatal(z.Err())
+			if z.Err() == io.EOF {
+				return "", fmt.Errorf("No season selector found")
+			}
+			return "", fmt.Errorf("error reading the schedule page, %v", z.Err())
 		case html.StartTagToken:
 			// Find select tags
 			name, hasAttr := z.TagName()
@@ -372,6 +692,9 @@ func getSeasonID(scheduleResp *http.Response) (string, error) {
 					// Find the season we are looking for in the next tokens
 					for {
 						tt = z.Next()
+						if tt == html.ErrorToken {
+							return "", fmt.Errorf("error reading the seasons, %v", z.Err())
+						}
 						name, _ = z.TagName()
 						// Finish if all teams have been iterated through
 						if tt == html.EndTagToken && string(name) == "select" {
@@ -397,6 +720,19 @@ func getSeasonID(scheduleResp *http.Response) (string, error) {
 	}
 }
 
+// getTeamName returns the name the team dropdown gives the team ID
+func getTeamName(teamID string, body []byte) (string, error) {
+	sel, ok := inspectPage(body).selects["ctl00$mainContent$ctl01$ddlTeams"]
+	if ok {
+		for i, value := range sel.values {
+			if value == teamID {
+				return strings.TrimSpace(sel.texts[i]), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("No team found with ID %s", teamID)
+}
+
 func getTeamID(teamName string, scheduleResp *http.Response) (string, error) {
 
 	log.Debugf("getTeamID: trying to find %s", teamName)
@@ -406,7 +742,10 @@ func getTeamID(teamName string, scheduleResp *http.Response) (string, error) {
 		tt := z.Next()
 		switch tt {
 		case html.ErrorToken:
-			log.Fatal(z.Err())
+			if z.Err() == io.EOF {
+				return "", fmt.Errorf("No team selector found")
+			}
+			return "", fmt.Errorf("error reading the schedule page, %v", z.Err())
 		case html.StartTagToken:
 			// Find select tags
 			name, hasAttr := z.TagName()
@@ -419,15 +758,26 @@ func getTeamID(teamName string, scheduleResp *http.Response) (string, error) {
 					var teamID []byte
 					for {
 						tt = z.Next()
+						if tt == html.ErrorToken {
+							return "", fmt.Errorf("error reading the teams, %v", z.Err())
+						}
 						name, _ = z.TagName()
 						// Finish if all teams have been iterated through
 						if tt == html.EndTagToken && string(name) == "select" {
 							log.Debug("getTeamId: FINISHED TEAMS!")
 							return "", fmt.Errorf("No team found matching %s", teamName)
 						}
-						// Save the teamId specified in the tag
+						// Save the teamId specified in the tag, the selected team's
+						// option has a selected attribute before it
 						if tt == html.StartTagToken && string(name) == "option" {
-							_, teamID, _ = z.TagAttr()
+							teamID = nil
+							for moreAttr := true; moreAttr; {
+								var key, val []byte
+								key, val, moreAttr = z.TagAttr()
+								if string(key) == "value" {
+									teamID = val
+								}
+							}
 						}
 						// Check if the text token matches your team
 						if tt == html.TextToken {
@@ -448,72 +798,14 @@ func getTeamID(teamName string, scheduleResp *http.Response) (string, error) {
 	}
 }
 
-/*
-	file, err := ioutil.ReadFile("example.xml") // For read access.
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	s := string(file)
-
-	// Find the dates in order
-	dateIdxs := findDaysOfWeek(s)
-	var dateStrs []string
-	for _, dateIdx := range dateIdxs {
-		dateEndIdx := strings.Index(s[dateIdx:], "<")
-		dateStr := s[dateIdx : dateIdx+dateEndIdx]
-		dateStrs = append(dateStrs, dateStr)
-	}
-
-	// Find the times in order
-	timeIdxs := findTime(s, dateIdxs)
-	var timeStrs []string
-	for _, timeIdx := range timeIdxs {
-		timeStr := s[timeIdx-6 : timeIdx+2]
-		timeStrs = append(timeStrs, timeStr)
-	}
+// stringList is a flag that may be given more than once
+type stringList []string
 
-	// Parse dates and times to time.Time
-	timeLayout := "  Monday, January 2, 2006, 03:04 PM MST"
-	for i, dateStr := range dateStrs {
-		dateTimeStr := dateStr + ", " + timeStrs[i] + " PST"
-		t, err := time.Parse(timeLayout, dateTimeStr)
-		if err != nil {
-			fmt.Printf("ERROR parsing times, %d, %v \n", i, err)
-			return
-		}
-		fmt.Printf("time: %v \n", t)
-	}
-*/
-
-func findTime(s string, daysIdxs []int) []int {
-	var idxs []int
-	for _, val := range daysIdxs {
-		idx := strings.Index(s[val:], "PM")
-		idxs = append(idxs, idx+val)
-	}
-	return idxs
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func findDaysOfWeek(s string) []int {
-	daysOfWeek := []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
-	var idxs []int
-	for _, day := range daysOfWeek {
-		t := s
-		var dayIdxs []int
-		for occ := 0; ; occ++ {
-			idx := strings.Index(t, day)
-			if idx == -1 {
-				break
-			}
-			var prev int
-			if occ > 0 {
-				prev = dayIdxs[occ-1] + 1
-			}
-			dayIdxs = append(dayIdxs, idx+prev)
-			t = t[idx+1:]
-		}
-		idxs = append(idxs, dayIdxs...)
-	}
-	return idxs
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetAllGames(t *testing.T) {
+
+	f, err := os.Open("example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	games, err := getAllGames(&http.Response{Body: f}, "733")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 2 {
+		t.Fatalf("got %d games, want 2", len(games))
+	}
+
+	g := games[0]
+	want := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	if !g.StartTime.Equal(want) {
+		t.Errorf("start time %v, want %v", g.StartTime, want)
+	}
+	if g.SeasonID != "733" || g.DivisionID != "483" {
+		t.Errorf("season %s division %s, want 733 and 483", g.SeasonID, g.DivisionID)
+	}
+	if g.VisitingTeamID != "4150" || g.VisitingTeam != "Degenerates FC" {
+		t.Errorf("visiting team %s %s, want 4150 Degenerates FC", g.VisitingTeamID, g.VisitingTeam)
+	}
+	if g.HomeTeamID != "4153" || g.HomeTeam != "Megpies FC" {
+		t.Errorf("home team %s %s, want 4153 Megpies FC", g.HomeTeamID, g.HomeTeam)
+	}
+	if g.Location != "Burnaby Indoor Soccer Centre" || g.Event != "Soccer" {
+		t.Errorf("event %q at %q", g.Event, g.Location)
+	}
+	if games[1].opponent("4153") != "Croatia U21" || games[1].isHome("4153") {
+		t.Errorf("second game is %s", games[1].summary("4153"))
+	}
+}
+
+func TestGetSeasonAndTeamID(t *testing.T) {
+
+	body, err := ioutil.ReadFile("example.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := func() *http.Response {
+		return &http.Response{Body: ioutil.NopCloser(bytes.NewReader(body))}
+	}
+
+	seasonID, err := getSeasonID(page())
+	if err != nil || seasonID != "733" {
+		t.Errorf("got season %q, %v, want 733", seasonID, err)
+	}
+	for name, want := range map[string]string{"Megpies FC": "4153", "Croatia U21": "4152"} {
+		teamID, err := getTeamID(name, page())
+		if err != nil || teamID != want {
+			t.Errorf("got team %q, %v for %s, want %s", teamID, err, name, want)
+		}
+	}
+	if _, err := getTeamID("Nobody FC", page()); err == nil {
+		t.Errorf("found a team that isn't in the dropdown")
+	}
+
+	// A page cut short is an error rather than the end of the process
+	truncated := &http.Response{Body: ioutil.NopCloser(bytes.NewReader(body[:bytes.Index(body, []byte("Boca Seniors"))]))}
+	if _, err := getTeamID("Megpies FC", truncated); err == nil {
+		t.Errorf("found a team in a truncated page")
+	}
+	if _, err := getSeasonID(&http.Response{Body: ioutil.NopCloser(strings.NewReader("<html></html>"))}); err == nil {
+		t.Errorf("found a season in a page without seasons")
+	}
+}
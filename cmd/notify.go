@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultWebhookTemplate is used when no template file is given. It renders a
+// JSON object with the change descriptions under both `text` and `content`, so
+// the same payload is accepted by Slack and Discord incoming webhooks.
+const defaultWebhookTemplate = `{
+  "text": {{ json .Summary }},
+  "content": {{ json .Summary }},
+  "team_id": {{ json .TeamID }},
+  "team_name": {{ json .TeamName }},
+  "changes": {{ json .Changes }}
+}
+`
+
+// notification is the data webhook templates are rendered against
+type notification struct {
+	TeamID   string
+	TeamName string
+	Changes  []change
+	Games    []game
+}
+
+// Summary describes every change on its own line
+func (n notification) Summary() string {
+	lines := []string{fmt.Sprintf("Schedule changes for %s:", n.TeamName)}
+	for _, c := range n.Changes {
+		lines = append(lines, c.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// webhookNotifier posts a payload rendered from a template to each of its URLs.
+// Posts that still fail after every attempt are appended to a dead-letter file
+// so they can be inspected and replayed by hand.
+type webhookNotifier struct {
+	URLs           []string
+	Template       *template.Template
+	Client         *http.Client
+	Attempts       int
+	Backoff        time.Duration // doubled after every failed attempt
+	DeadLetterPath string
+}
+
+// webhookFuncs are the functions available to webhook templates
+var webhookFuncs = template.FuncMap{
+	// json encodes a value as JSON, strings included, so it can be placed
+	// directly in a JSON template
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// when formats a time in the league time zone
+	"when": func(t time.Time) string {
+		return t.In(leagueLocation).Format(changeTimeLayout)
+	},
+}
+
+// newWebhookNotifier creates a notifier for the URLs. The payload template is read
+// from templatePath, or the default template is used if it is empty.
+func newWebhookNotifier(urls []string, templatePath string, deadLetterPath string) (*webhookNotifier, error) {
+
+	text := defaultWebhookTemplate
+	if templatePath != "" {
+		b, err := ioutil.ReadFile(templatePath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading webhook template, %v", err)
+		}
+		text = string(b)
+	}
+	tmpl, err := template.New("webhook").Funcs(webhookFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing webhook template, %v", err)
+	}
+
+	return &webhookNotifier{
+		URLs:           urls,
+		Template:       tmpl,
+		Client:         &http.Client{Timeout: 10 * time.Second},
+		Attempts:       4,
+		Backoff:        time.Second,
+		DeadLetterPath: deadLetterPath,
+	}, nil
+}
+
+// Notify renders the payload for the notification and posts it to every URL. An
+// error is returned if any post fails, after it has been dead-lettered.
+func (n *webhookNotifier) Notify(ev notification) error {
+
+	var buf bytes.Buffer
+	if err := n.Template.Execute(&buf, ev); err != nil {
+		return fmt.Errorf("error rendering webhook payload, %v", err)
+	}
+	payload := buf.Bytes()
+
+	var failed []string
+	for _, url := range n.URLs {
+		err := n.post(url, payload)
+		if err == nil {
+			log.Debugf("Notify: posted %d changes to %s", len(ev.Changes), url)
+			continue
+		}
+		log.Errorf("Notify: giving up on %s, %v", url, err)
+		failed = append(failed, url)
+		if dlErr := n.deadLetter(url, payload, err); dlErr != nil {
+			log.Errorf("Notify: %v", dlErr)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("error notifying %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// post sends the payload to the URL, retrying server errors, rate limiting and
+// network errors with exponential backoff
+func (n *webhookNotifier) post(url string, payload []byte) error {
+
+	backoff := n.Backoff
+	var err error
+	for attempt := 1; attempt <= n.Attempts; attempt++ {
+		var retry bool
+		retry, err = n.postOnce(url, payload)
+		if err == nil || !retry {
+			return err
+		}
+		if attempt < n.Attempts {
+			log.Warnf("post: attempt %d to %s failed, retrying in %v, %v", attempt, url, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// postOnce sends the payload once, and reports whether a failure is worth retrying
+func (n *webhookNotifier) postOnce(url string, payload []byte) (retry bool, err error) {
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s: %s", resp.Status, body)
+	default:
+		return false, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+}
+
+// deadLetter appends a payload that could not be delivered to the dead-letter
+// file, one JSON object per line
+func (n *webhookNotifier) deadLetter(url string, payload []byte, postErr error) error {
+
+	if n.DeadLetterPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(n.DeadLetterPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening dead-letter log, %v", err)
+	}
+	defer f.Close()
+
+	entry := struct {
+		Time    time.Time `json:"time"`
+		URL     string    `json:"url"`
+		Error   string    `json:"error"`
+		Payload string    `json:"payload"`
+	}{time.Now(), url, postErr.Error(), string(payload)}
+	return json.NewEncoder(f).Encode(entry)
+}
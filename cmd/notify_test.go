@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNotifier is a notifier with the default template that doesn't wait between
+// attempts
+func testNotifier(t *testing.T, urls ...string) *webhookNotifier {
+	t.Helper()
+	n, err := newWebhookNotifier(urls, "", filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Backoff = time.Millisecond
+	return n
+}
+
+func TestWebhookPostRetries(t *testing.T) {
+
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("content type %q", r.Header.Get("Content-Type"))
+		}
+	}))
+	defer srv.Close()
+
+	if err := testNotifier(t, srv.URL).post(srv.URL, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+}
+
+func TestWebhookPostGivesUpOnClientErrors(t *testing.T) {
+
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Error(w, "no such hook", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	err := testNotifier(t, srv.URL).post(srv.URL, []byte(`{}`))
+	if err == nil || !strings.Contains(err.Error(), "no such hook") {
+		t.Fatalf("got error %v, want the response body", err)
+	}
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want 1", attempts)
+	}
+}
+
+func TestWebhookNotifyDeadLetters(t *testing.T) {
+
+	var payload map[string]interface{}
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("payload isn't JSON, %v", err)
+		}
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	n := testNotifier(t, ok.URL, failing.URL)
+	g := testGame(time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation), "4150", "4153")
+	ev := notification{TeamID: "4153", TeamName: "Megpies FC", Changes: []change{{Type: changeAdded, TeamID: "4153", After: &g}}}
+
+	err := n.Notify(ev)
+	if err == nil || !strings.Contains(err.Error(), failing.URL) {
+		t.Fatalf("got error %v, want %s to have failed", err, failing.URL)
+	}
+	if payload["team_id"] != "4153" || !strings.Contains(payload["text"].(string), "Added: Degenerates FC @ Megpies FC") {
+		t.Errorf("got payload %v", payload)
+	}
+
+	b, err := ioutil.ReadFile(n.DeadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(lines))
+	}
+	var entry struct {
+		URL     string `json:"url"`
+		Error   string `json:"error"`
+		Payload string `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.URL != failing.URL || !strings.Contains(entry.Error, "500") || !strings.Contains(entry.Payload, `"team_name": "Megpies FC"`) {
+		t.Errorf("got dead letter %+v", entry)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// defaultProfile is the profile of the teams and sinks at the top of the config
+// file, which aren't anyone's in particular
+const defaultProfile = "default"
+
+// profile is someone following teams in calendars of their own. The sinks of a
+// named profile keep their tokens in the profile's own directory.
+type profile struct {
+	Name  string
+	Teams []teamConfig
+	Sinks []sinkOptions
+}
+
+// profileSink is a calendar of a profile that a team is synced to
+type profileSink struct {
+	Profile string
+	Sink    sinkOptions
+}
+
+// followedTeam is a team followed by one or more profiles. It is scraped once and
+// synced to the calendars of every profile following it.
+type followedTeam struct {
+	Team     teamRef
+	Schedule string // empty for the default schedule
+	Syncs    []profileSink
+}
+
+// profiles returns the profiles of the config file, the teams and sinks at the
+// top of it being the default profile. A profile listing no sinks uses the sink
+// flags, as does every profile when override is set.
+func (c *config) profiles(flagSinks []sinkOptions, override bool) ([]profile, error) {
+
+	var profiles []profile
+	if len(c.Teams) > 0 {
+		sinks := flagSinks
+		if !override && len(c.Sinks) > 0 {
+			var err error
+			if sinks, err = c.sinkOptions(); err != nil {
+				return nil, err
+			}
+		}
+		profiles = append(profiles, profile{Name: defaultProfile, Teams: c.Teams, Sinks: sinks})
+	}
+
+	for i, pc := range c.Profiles {
+		p := profile{Name: pc.Name, Teams: pc.Teams}
+		tokenDir := pc.Tokens
+		if tokenDir == "" {
+			dir, err := configDir()
+			if err != nil {
+				return nil, err
+			}
+			tokenDir = filepath.Join(dir, "profiles", pc.Name)
+		}
+		var passphrase string
+		if pc.TokenPassphrase != "" {
+			var err error
+			if passphrase, err = pc.TokenPassphrase.resolve(); err != nil {
+				return nil, fmt.Errorf("profiles[%d].token_passphrase: %v", i, err)
+			}
+		}
+
+		sinks := flagSinks
+		if !override && len(pc.Sinks) > 0 {
+			sinks = nil
+			for j, sc := range pc.Sinks {
+				o, err := sc.options()
+				if err != nil {
+					return nil, fmt.Errorf("profiles[%d].sinks[%d]: %v", i, j, err)
+				}
+				sinks = append(sinks, o)
+			}
+		}
+		for _, o := range sinks {
+			o.TokenDir = tokenDir
+			o.TokenPassphrase = passphrase
+			p.Sinks = append(p.Sinks, o)
+		}
+		profiles = append(profiles, p)
+	}
+
+	for _, p := range profiles {
+		for _, o := range p.Sinks {
+			if err := o.validate(); err != nil {
+				return nil, fmt.Errorf("profile %s: %v", p.Name, err)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// followedTeams returns every team the profiles follow once, in the order they
+// are first listed, with the calendars of every profile following it
+func followedTeams(profiles []profile) []followedTeam {
+
+	var teams []followedTeam
+	index := make(map[string]int)
+	for _, p := range profiles {
+		for _, tc := range p.Teams {
+			ref := tc.ref()
+			i, ok := index[ref.key()]
+			if !ok {
+				i = len(teams)
+				index[ref.key()] = i
+				teams = append(teams, followedTeam{Team: ref})
+			}
+			if teams[i].Schedule == "" {
+				teams[i].Schedule = tc.Schedule
+			}
+			for _, o := range p.Sinks {
+				teams[i].Syncs = append(teams[i].Syncs, profileSink{Profile: p.Name, Sink: o})
+			}
+		}
+	}
+	return teams
+}
+
+// teamRefs returns every team of the config file once, whichever profiles follow
+// them
+func (c *config) teamRefs() []teamRef {
+	teams := append([]teamConfig{}, c.Teams...)
+	for _, p := range c.Profiles {
+		teams = append(teams, p.Teams...)
+	}
+	var refs []teamRef
+	seen := make(map[string]bool)
+	for _, t := range teams {
+		if ref := t.ref(); !seen[ref.key()] {
+			seen[ref.key()] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
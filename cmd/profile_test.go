@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSyncTeamsProfiles(t *testing.T) {
+
+	const profiles = `
+teams: [{name: Megpies FC}]
+sinks: [{type: ics, file: default.ics}]
+profiles:
+  - name: alex
+    tokens: /tokens/alex
+    teams: [{name: Megpies FC}, {name: Croatia U21}]
+    sinks: [{type: ics, file: alex.ics}, {type: stdout}]
+  - name: sam
+    tokens: /tokens/sam
+    teams: [{name: Croatia U21}]
+`
+
+	tests := []struct {
+		name    string
+		yaml    string
+		args    []string
+		profile string
+		want    []string
+		err     string
+	}{
+		{
+			name: "default profile",
+			yaml: "teams: [{name: Megpies FC}, {id: \"4150\"}]\nsinks: [{type: ics, file: default.ics}]\n",
+			want: []string{"Megpies FC: default ics default.ics", "4150: default ics default.ics"},
+		},
+		{
+			name: "no config",
+			args: []string{"-sink", "ics", "-ics-file", "flag.ics"},
+			want: []string{"Megpies FC: - ics flag.ics"},
+		},
+		{
+			// A team followed by several profiles is scraped once for all of them,
+			// and a profile without sinks uses the sink flags
+			name: "every profile",
+			yaml: profiles,
+			want: []string{
+				"Megpies FC: default ics default.ics, alex ics alex.ics /tokens/alex, alex stdout  /tokens/alex",
+				"Croatia U21: alex ics alex.ics /tokens/alex, alex stdout  /tokens/alex, sam stdout  /tokens/sam",
+			},
+		},
+		{
+			name:    "one profile",
+			yaml:    profiles,
+			profile: "sam",
+			want:    []string{"Croatia U21: sam stdout  /tokens/sam"},
+		},
+		{
+			// The sink flags override the sinks of every profile
+			name:    "sink flag",
+			yaml:    profiles,
+			args:    []string{"-sink", "ics", "-ics-file", "flag.ics"},
+			profile: "alex",
+			want:    []string{"Megpies FC: alex ics flag.ics /tokens/alex", "Croatia U21: alex ics flag.ics /tokens/alex"},
+		},
+		{
+			name:    "unknown profile",
+			yaml:    profiles,
+			profile: "nobody",
+			err:     "there is no profile nobody",
+		},
+		{
+			name:    "profile with -tn",
+			yaml:    profiles,
+			args:    []string{"-tn", "Megpies FC"},
+			profile: "alex",
+			err:     "-profile needs the profiles of a config file",
+		},
+	}
+
+	for _, tt := range tests {
+		var c config
+		if err := c.parse([]byte(tt.yaml)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := c.validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+		teamName := fs.String("tn", "Megpies FC", "")
+		var opts sinkOptions
+		opts.register(fs, "stdout")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		teams, err := syncTeams(&c, fs, *teamName, tt.profile, opts)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, team := range teams {
+			var syncs []string
+			for _, s := range team.Syncs {
+				profile := s.Profile
+				if profile == "" {
+					profile = "-"
+				}
+				syncs = append(syncs, strings.TrimSpace(fmt.Sprintf("%s %s %s %s", profile, s.Sink.Sink, s.Sink.ICSFile, filepath.ToSlash(s.Sink.TokenDir))))
+			}
+			name := team.Team.Name
+			if name == "" {
+				name = team.Team.ID
+			}
+			got = append(got, name+": "+strings.Join(syncs, ", "))
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
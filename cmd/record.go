@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// redacted stands in for cookie values in recordings
+const redacted = "REDACTED"
+
+// errNotRecorded is returned when a replayed request isn't in the recording,
+// retrying it can't help
+var errNotRecorded = errors.New("no recorded response")
+
+// recordedExchange is a request to the site and the response to it, as a
+// recording keeps it. The body of the response is kept next to it in BodyFile,
+// decoded, so it can be used as a fixture as it is.
+type recordedExchange struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"request_header"`
+	RequestBody   string      `json:"request_body,omitempty"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header"`
+	BodyFile      string      `json:"body_file"`
+
+	body []byte
+}
+
+// recordingTransport saves every exchange with the site in a directory, as
+// 0001-GET.json and its body, numbered in the order they were sent. Cookies are
+// redacted, so a recording can be shared.
+type recordingTransport struct {
+	Dir  string
+	Next http.RoundTripper
+
+	mu  sync.Mutex
+	seq int
+}
+
+// newRecordingTransport returns a transport recording what next sends to dir,
+// numbering on from any recording already there
+func newRecordingTransport(dir string, next http.RoundTripper) (*recordingTransport, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating recording directory, %v", err)
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	return &recordingTransport{Dir: dir, Next: next, seq: len(existing)}, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	var reqBody []byte
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		if reqBody, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Keep the body decoded, and hand it on that way, so the fixture is readable
+	if body, err = decodeBody(resp.Header.Get("Content-Encoding"), body); err != nil {
+		return nil, fmt.Errorf("error decoding response to %s %s, %v", req.Method, req.URL, err)
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	t.mu.Lock()
+	t.seq++
+	name := fmt.Sprintf("%04d-%s", t.seq, req.Method)
+	t.mu.Unlock()
+
+	ex := recordedExchange{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		RequestHeader: redactHeader(req.Header),
+		RequestBody:   string(reqBody),
+		Status:        resp.StatusCode,
+		Header:        redactHeader(resp.Header),
+		BodyFile:      name + bodyExtension(resp.Header.Get("Content-Type")),
+	}
+	if err := t.save(name, ex, body); err != nil {
+		// The scrape goes on, only the recording is short
+		log.Errorf("RoundTrip: error recording %s %s, %v", req.Method, req.URL, err)
+	}
+	return resp, nil
+}
+
+func (t *recordingTransport) save(name string, ex recordedExchange, body []byte) error {
+	if err := writeFileAtomic(filepath.Join(t.Dir, ex.BodyFile), body, 0600); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(ex, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(t.Dir, name+".json"), b, 0600)
+}
+
+// replayTransport answers requests with the responses in a recording, without
+// going near the site. A request gets the first response not yet used to a
+// request with the same method, URL and body, or failing that the same method
+// and URL. Once they are all used the last one is served again, so a daemon can
+// run on a recording.
+type replayTransport struct {
+	exchanges []recordedExchange
+
+	mu   sync.Mutex
+	used []bool
+}
+
+// newReplayTransport loads the recording in dir
+func newReplayTransport(dir string) (*replayTransport, error) {
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no recording in %s", dir)
+	}
+	sort.Strings(paths)
+
+	t := &replayTransport{}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading recording, %v", err)
+		}
+		var ex recordedExchange
+		if err := json.Unmarshal(b, &ex); err != nil {
+			return nil, fmt.Errorf("error parsing recording %s, %v", path, err)
+		}
+		if ex.body, err = ioutil.ReadFile(filepath.Join(dir, ex.BodyFile)); err != nil {
+			return nil, fmt.Errorf("error reading recording, %v", err)
+		}
+		t.exchanges = append(t.exchanges, ex)
+	}
+	t.used = make([]bool, len(t.exchanges))
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ex, ok := t.match(req.Method, req.URL.String(), string(reqBody))
+	if !ok {
+		return nil, errNotRecorded
+	}
+	log.Debugf("RoundTrip: replaying %s for %s %s", ex.BodyFile, req.Method, req.URL)
+	header := ex.Header.Clone()
+	if header == nil {
+		// A hand-written recording may leave the headers out
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(ex.body)),
+		ContentLength: int64(len(ex.body)),
+		Request:       req,
+	}, nil
+}
+
+func (t *replayTransport) match(method string, target string, body string) (recordedExchange, bool) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, sameBody := range []bool{true, false} {
+		for i, ex := range t.exchanges {
+			if !t.used[i] && ex.Method == method && ex.URL == target && (!sameBody || ex.RequestBody == body) {
+				t.used[i] = true
+				return ex, true
+			}
+		}
+	}
+	// Every match has been used, serve the last of them again
+	for i := len(t.exchanges) - 1; i >= 0; i-- {
+		if ex := t.exchanges[i]; ex.Method == method && ex.URL == target {
+			return ex, true
+		}
+	}
+	return recordedExchange{}, false
+}
+
+// redactHeader returns a copy of the header with the values of cookies and any
+// credentials replaced, keeping the cookie names and attributes
+func redactHeader(h http.Header) http.Header {
+
+	h = h.Clone()
+	if h.Get("Authorization") != "" {
+		h.Set("Authorization", redacted)
+	}
+	for i, v := range h.Values("Cookie") {
+		pairs := strings.Split(v, ";")
+		for j, pair := range pairs {
+			pairs[j] = redactPair(pair)
+		}
+		h["Cookie"][i] = strings.Join(pairs, ";")
+	}
+	for i, v := range h.Values("Set-Cookie") {
+		// Only the first pair is the cookie, the rest are its attributes
+		parts := strings.SplitN(v, ";", 2)
+		parts[0] = redactPair(parts[0])
+		h["Set-Cookie"][i] = strings.Join(parts, ";")
+	}
+	return h
+}
+
+// redactPair replaces the value of a name=value pair
+func redactPair(pair string) string {
+	i := strings.Index(pair, "=")
+	if i < 0 {
+		return pair
+	}
+	return pair[:i+1] + redacted
+}
+
+// bodyExtension returns the file extension for a body of the content type
+func bodyExtension(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasSuffix(mediaType, "html"):
+		return ".html"
+	case strings.HasSuffix(mediaType, "xml"):
+		return ".xml"
+	}
+	return ".txt"
+}
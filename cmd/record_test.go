@@ -0,0 +1,99 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			b, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("posted " + string(b)))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "ASP.NET_SessionId", Value: "secret-session", Path: "/"})
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte("<html>schedule</html>"))
+		zw.Close()
+	}))
+	dir := t.TempDir()
+
+	// exchange sends the requests a scrape does and returns the bodies
+	exchange := func(client *http.Client) []string {
+		t.Helper()
+		get, _ := http.NewRequest("GET", srv.URL+"/schedule.aspx", nil)
+		get.Header.Set("Cookie", "ASP.NET_SessionId=secret-session")
+		post, _ := http.NewRequest("POST", srv.URL+"/schedule.aspx", strings.NewReader("team=4153"))
+		var bodies []string
+		for _, req := range []*http.Request{get, post} {
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			bodies = append(bodies, string(b))
+		}
+		return bodies
+	}
+
+	rt, err := newRecordingTransport(dir, &http.Transport{DisableCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := exchange(&http.Client{Transport: rt})
+	if recorded[0] != "<html>schedule</html>" || recorded[1] != "posted team=4153" {
+		t.Fatalf("got %q while recording", recorded)
+	}
+	srv.Close()
+
+	// The fixtures are decoded and the cookies redacted
+	body, err := ioutil.ReadFile(filepath.Join(dir, "0001-GET.html"))
+	if err != nil || string(body) != "<html>schedule</html>" {
+		t.Errorf("got body file %q, %v", body, err)
+	}
+	ex, err := ioutil.ReadFile(filepath.Join(dir, "0001-GET.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(ex), "secret-session") || !strings.Contains(string(ex), "ASP.NET_SessionId="+redacted) {
+		t.Errorf("cookies aren't redacted in\n%s", ex)
+	}
+
+	// The server is gone, so everything comes from the recording
+	replay, err := newReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: replay}
+	replayed := exchange(client)
+	if strings.Join(replayed, "|") != strings.Join(recorded, "|") {
+		t.Errorf("replayed %q, recorded %q", replayed, recorded)
+	}
+	if _, err := client.Get(srv.URL + "/other.aspx"); !errors.Is(err, errNotRecorded) {
+		t.Errorf("got %v for a request that wasn't recorded, want %v", err, errNotRecorded)
+	}
+
+	// A recording missing a fixture isn't replayed
+	if err := os.Remove(filepath.Join(dir, "0002-POST.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newReplayTransport(dir); err == nil {
+		t.Errorf("replaying a recording missing a body")
+	}
+	if _, err := newReplayTransport(t.TempDir()); err == nil {
+		t.Errorf("replaying an empty recording")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// schedule says when a team is next scraped
+type schedule interface {
+	// Next returns the first time after t the team should be scraped
+	Next(t time.Time) time.Time
+}
+
+// parseSchedule parses a schedule, either a five field cron expression
+// (minute hour day-of-month month day-of-week) evaluated in the league time zone,
+// "@every <duration>", or one of @hourly, @daily and @weekly
+func parseSchedule(spec string) (schedule, error) {
+
+	spec = strings.TrimSpace(spec)
+	switch {
+	case strings.HasPrefix(spec, "@every "):
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q, %v", spec, err)
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("invalid schedule %q, the interval must be at least a minute", spec)
+		}
+		return everySchedule{d}, nil
+	case spec == "@hourly":
+		spec = "0 * * * *"
+	case spec == "@daily":
+		spec = "0 0 * * *"
+	case spec == "@weekly":
+		spec = "0 0 * * 0"
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected five cron fields or @every <duration>", spec)
+	}
+	var c cronSchedule
+	var err error
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	} {
+		if *f.bits, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q, %v", spec, err)
+		}
+	}
+	// Sunday may be written as 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDOM = fields[2] == "*"
+	c.anyDOW = fields[4] == "*"
+	return c, nil
+}
+
+// everySchedule runs at a fixed interval
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// cronSchedule runs at the times matching a cron expression, each field a set of
+// bits. As in cron, when both days are restricted a day matching either will do.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDOM, anyDOW                bool
+}
+
+func (s cronSchedule) Next(t time.Time) time.Time {
+
+	t = t.In(leagueLocation).Truncate(time.Minute).Add(time.Minute)
+	// Give up after five years, the expression can't match, like 0 0 30 2 *
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, leagueLocation)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, leagueLocation)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			// Truncating would round to the hour in UTC, which isn't the local
+			// hour in zones offset by a half hour
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, leagueLocation)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDOM || s.anyDOW {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseCronField parses a comma separated list of *, values, ranges and steps
+// like */15 or 1-5/2 into a set of bits
+func parseCronField(field string, min int, max int) (uint64, error) {
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			v, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			lo, hi = v, v
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// pollWindows are how the adaptive schedule polls around games
+type pollWindows struct {
+	Before time.Duration // how long before kickoff polling speeds up
+	After  time.Duration // how long after the game ends it stays fast
+	Fast   time.Duration // the interval inside a window
+	Slow   time.Duration // the interval outside every window
+}
+
+// adaptiveSchedule polls often in the hours around the team's games, for scores
+// and last-minute changes, and rarely the rest of the week. The games are read
+// from the store, so the schedule follows the latest scrape.
+type adaptiveSchedule struct {
+	store   *Store
+	team    teamRef
+	windows pollWindows
+}
+
+// newAdaptiveSchedule returns an adaptive schedule for the team
+func newAdaptiveSchedule(store *Store, team teamRef, windows pollWindows) (*adaptiveSchedule, error) {
+	if windows.Fast < time.Minute || windows.Slow < windows.Fast {
+		return nil, fmt.Errorf("invalid poll intervals, fast must be at least a minute and slow no faster than fast")
+	}
+	if windows.Before < 0 || windows.After < 0 {
+		return nil, fmt.Errorf("invalid poll windows, they can't be negative")
+	}
+	return &adaptiveSchedule{store: store, team: team, windows: windows}, nil
+}
+
+func (s *adaptiveSchedule) Next(t time.Time) time.Time {
+	next, err := s.next(t)
+	if err != nil {
+		// Without the games, poll fast until a scrape has stored them
+		log.Warnf("Next: polling %s every %v, %v", s.team, s.windows.Fast, err)
+		return t.Add(s.windows.Fast)
+	}
+	return next
+}
+
+// next returns t plus the fast interval if t is in the window of a game,
+// otherwise t plus the slow interval or the opening of the next window,
+// whichever is sooner
+func (s *adaptiveSchedule) next(t time.Time) (time.Time, error) {
+
+	w := s.windows
+	tm, err := s.store.TeamByRef(s.team)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Games that started up to a window ago may still be in their window
+	games, err := s.store.UpcomingGames(tm.ID, t.Add(-(gameDuration + w.After)), t.Add(w.Slow+w.Before))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	next := t.Add(w.Slow)
+	for _, g := range games {
+		opens := g.StartTime.Add(-w.Before)
+		closes := g.StartTime.Add(gameDuration + w.After)
+		switch {
+		case !t.Before(opens) && t.Before(closes):
+			return t.Add(w.Fast), nil
+		case opens.After(t) && opens.Before(next):
+			next = opens
+		}
+	}
+	return next, nil
+}
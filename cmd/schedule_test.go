@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{"", "@every 10s", "@every soon", "* * * *", "60 * * * *", "*/0 * * * *", "0 0 * 13 *", "5-1 * * * *"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parsed %q", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+
+	// Friday September 13 2019, 10:07 in the league time zone
+	from := time.Date(2019, time.September, 13, 10, 7, 30, 0, leagueLocation)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"@every 90m", from.Add(90 * time.Minute)},
+		{"*/15 * * * *", time.Date(2019, time.September, 13, 10, 15, 0, 0, leagueLocation)},
+		{"@hourly", time.Date(2019, time.September, 13, 11, 0, 0, 0, leagueLocation)},
+		{"@daily", time.Date(2019, time.September, 14, 0, 0, 0, 0, leagueLocation)},
+		{"@weekly", time.Date(2019, time.September, 15, 0, 0, 0, 0, leagueLocation)},
+		{"0 9 * * 1-5", time.Date(2019, time.September, 16, 9, 0, 0, 0, leagueLocation)},
+		{"30 18 * * 7", time.Date(2019, time.September, 15, 18, 30, 0, 0, leagueLocation)},
+		{"0,30 8-9 1 10 *", time.Date(2019, time.October, 1, 8, 0, 0, 0, leagueLocation)},
+		// Either day will do when both are restricted
+		{"0 12 20 * 6", time.Date(2019, time.September, 14, 12, 0, 0, 0, leagueLocation)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%s: next is %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestCronScheduleNextInLeagueTime(t *testing.T) {
+
+	s, err := parseSchedule("0 6 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 6 AM in Vancouver is 13:00 UTC in summer and 14:00 UTC in winter
+	summer := s.Next(time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC))
+	if want := time.Date(2019, time.July, 1, 13, 0, 0, 0, time.UTC); !summer.Equal(want) {
+		t.Errorf("next is %v, want %v", summer.UTC(), want)
+	}
+	winter := s.Next(time.Date(2019, time.December, 1, 0, 0, 0, 0, time.UTC))
+	if want := time.Date(2019, time.December, 1, 14, 0, 0, 0, time.UTC); !winter.Equal(want) {
+		t.Errorf("next is %v, want %v", winter.UTC(), want)
+	}
+}
+
+func TestCronScheduleNextInHalfHourZone(t *testing.T) {
+
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(loc *time.Location) { leagueLocation = loc }(leagueLocation)
+	leagueLocation = kolkata
+
+	s, err := parseSchedule("0 11 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2019, time.September, 13, 10, 31, 0, 0, kolkata)
+	if got, want := s.Next(from), time.Date(2019, time.September, 13, 11, 0, 0, 0, kolkata); !got.Equal(want) {
+		t.Errorf("next is %v, want %v", got, want)
+	}
+}
+
+func TestAdaptiveScheduleWindows(t *testing.T) {
+
+	store := openTestStore(t)
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	saveScrape(t, store, "4153", []game{
+		testGame(kickoff, "4150", "4153"),
+		testGame(kickoff.AddDate(0, 0, 7), "4153", "4152"),
+	}, kickoff.AddDate(0, 0, -10))
+
+	windows := pollWindows{Before: 3 * time.Hour, After: 2 * time.Hour, Fast: 15 * time.Minute, Slow: 6 * time.Hour}
+	s, err := newAdaptiveSchedule(store, teamRef{ID: "4153"}, windows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day int, hour int, min int) time.Time {
+		return time.Date(2019, time.September, day, hour, min, 0, 0, leagueLocation)
+	}
+
+	// The window of the game is 16:00 until 22:00, two hours after it ends
+	tests := []struct {
+		name string
+		from time.Time
+		want time.Time
+	}{
+		{"game day morning", at(12, 9, 0), at(12, 15, 0)},
+		{"slow poll reaching the window", at(12, 10, 0), at(12, 16, 0)},
+		{"before the window", at(12, 15, 59), at(12, 16, 0)},
+		{"window opens", at(12, 16, 0), at(12, 16, 15)},
+		{"kickoff", at(12, 19, 0), at(12, 19, 15)},
+		{"window closing", at(12, 21, 59), at(12, 22, 14)},
+		{"window closed", at(12, 22, 0), at(13, 4, 0)},
+		{"off season", at(12, 19, 0).AddDate(0, 2, 0), at(12, 19, 0).AddDate(0, 2, 0).Add(6 * time.Hour)},
+	}
+	for _, tt := range tests {
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: next is %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Until the team has been scraped it is polled fast
+	unknown, err := newAdaptiveSchedule(store, teamRef{ID: "9999"}, windows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := unknown.Next(at(12, 9, 0)), at(12, 9, 15); !got.Equal(want) {
+		t.Errorf("next of an unknown team is %v, want %v", got, want)
+	}
+
+	if _, err := newAdaptiveSchedule(store, teamRef{ID: "4153"}, pollWindows{Fast: time.Hour, Slow: time.Minute}); err == nil {
+		t.Errorf("made a schedule polling slower around games than the rest of the time")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// feedServer serves the stored schedule as subscribable iCalendar feeds
+//
+//	GET /teams/{teamID}.ics
+//	GET /divisions/{divisionID}.ics
+type feedServer struct {
+	store *Store
+}
+
+// serveCommand serves calendar feeds over HTTP, scraping the teams in the
+// background so the feeds stay current. Without -tn the teams of the config file
+// are refreshed.
+func serveCommand(args []string) error {
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var configPath = fs.String("config", "", configUsage)
+	var addr = fs.String("addr", ":8080", "Address to listen on")
+	var dbPath = fs.String("db", "8rinks.db", "Path to the SQLite database the schedule is stored in")
+	var teamNames stringList
+	fs.Var(&teamNames, "tn", "Team name to keep refreshed in the background, may be repeated")
+	var refresh = fs.Duration("refresh", time.Hour, "How often the teams are scraped, 0 to never scrape")
+	var site siteFlags
+	site.register(fs)
+	fs.Parse(args)
+
+	cfg, err := configure(fs, *configPath)
+	if err != nil {
+		return err
+	}
+	if err := site.apply(); err != nil {
+		return err
+	}
+	var teams []teamRef
+	for _, name := range teamNames {
+		teams = append(teams, teamRef{Name: name})
+	}
+	if len(teams) == 0 {
+		teams = cfg.teamRefs()
+	}
+
+	store, err := OpenStore(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if len(teams) > 0 && *refresh > 0 {
+		go refreshTeams(store, teams, *refresh)
+	}
+
+	fsrv := &feedServer{store: store}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/teams/", fsrv.teamFeed)
+	mux.HandleFunc("/divisions/", fsrv.divisionFeed)
+
+	// Calendar apps poll the feeds unattended, a slow or stalled one mustn't
+	// hold on to its connection
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Infof("Serving calendar feeds on %s", *addr)
+	return srv.ListenAndServe()
+}
+
+// refreshTeams scrapes every team straight away and then once every interval
+func refreshTeams(store *Store, teams []teamRef, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, team := range teams {
+			result, changes, err := scrapeAndSave(context.Background(), store, team)
+			if err != nil {
+				log.Errorf("refreshTeams: error scraping %s, %v", team, err)
+				continue
+			}
+			log.Infof("refreshTeams: scraped %d games and %d changes for %s", len(result.Games), len(changes), result.TeamName)
+		}
+		<-ticker.C
+	}
+}
+
+// teamFeed serves the games of a team, described from the team's point of view
+func (fsrv *feedServer) teamFeed(w http.ResponseWriter, r *http.Request) {
+
+	teamID, ok := feedID(r.URL.Path, "/teams/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	t, err := fsrv.store.Team(teamID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	games, modified, err := fsrv.store.TeamCalendarGames(teamID)
+	if err != nil {
+		log.Errorf("teamFeed: %v", err)
+		http.Error(w, "error reading schedule", http.StatusInternalServerError)
+		return
+	}
+	fsrv.serveCalendar(w, r, calendarName(t.Name), games, teamSummary(teamID), modified)
+}
+
+// divisionFeed serves every game in a division
+func (fsrv *feedServer) divisionFeed(w http.ResponseWriter, r *http.Request) {
+
+	divisionID, ok := feedID(r.URL.Path, "/divisions/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := fsrv.store.Division(divisionID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	games, modified, err := fsrv.store.DivisionCalendarGames(divisionID)
+	if err != nil {
+		log.Errorf("divisionFeed: %v", err)
+		http.Error(w, "error reading schedule", http.StatusInternalServerError)
+		return
+	}
+	name := d.Name
+	if name == "" {
+		name = "Division " + d.ID
+	}
+	fsrv.serveCalendar(w, r, calendarName(name), games, fixtureSummary, modified)
+}
+
+// serveCalendar renders the calendar and serves it with an ETag and Last-Modified,
+// answering conditional requests with 304 Not Modified. DTSTAMP is set to when the
+// games last changed so the same schedule always renders the same bytes, or to
+// now for a feed without games.
+func (fsrv *feedServer) serveCalendar(w http.ResponseWriter, r *http.Request, name string,
+	games []game, summary func(g game) string, modified time.Time) {
+
+	if modified.IsZero() {
+		modified = time.Now().UTC().Truncate(time.Second)
+	}
+
+	var buf bytes.Buffer
+	if err := writeCalendar(&buf, name, games, summary, modified); err != nil {
+		log.Errorf("serveCalendar: %v", err)
+		http.Error(w, "error rendering calendar", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(buf.Bytes())))
+	w.Header().Set("Cache-Control", "max-age=300")
+	http.ServeContent(w, r, "", modified, bytes.NewReader(buf.Bytes()))
+}
+
+// feedID returns the ID in a path like /teams/4153.ics
+func feedID(path string, prefix string) (string, bool) {
+	id := strings.TrimPrefix(path, prefix)
+	if !strings.HasSuffix(id, ".ics") {
+		return "", false
+	}
+	id = strings.TrimSuffix(id, ".ics")
+	if id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+	return id, true
+}
+
+// fixtureSummary describes games as visiting team @ home team
+func fixtureSummary(g game) string {
+	return fmt.Sprintf("%s @ %s", g.VisitingTeam, g.HomeTeam)
+}
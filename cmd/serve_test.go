@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTeamFeedStaysTheSameAcrossScrapes(t *testing.T) {
+
+	store := openTestStore(t)
+	now := time.Date(2019, time.September, 1, 12, 0, 0, 0, leagueLocation)
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	games := func() []game {
+		return []game{testGame(kickoff, "4150", "4153"), testGame(kickoff.AddDate(0, 0, 7), "4153", "4152")}
+	}
+	saveScrape(t, store, "4153", games(), now)
+
+	// Age the games so a bumped updated_at can't go unnoticed within a second
+	if _, err := store.db.Exec(`UPDATE games SET updated_at = ?`, formatTime(now)); err != nil {
+		t.Fatal(err)
+	}
+
+	fsrv := &feedServer{store: store}
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/teams/4153.ics", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		fsrv.teamFeed(w, r)
+		return w
+	}
+	first := get("")
+	if first.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", first.Code)
+	}
+	etag := first.Header().Get("ETag")
+	if lm := first.Header().Get("Last-Modified"); lm != now.UTC().Format(http.TimeFormat) {
+		t.Errorf("Last-Modified %s, want %s", lm, now.UTC().Format(http.TimeFormat))
+	}
+
+	// Scraping the same schedule again changes nothing
+	saveScrape(t, store, "4153", games(), now)
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Fatalf("got %d after an unchanged scrape, want 304", w.Code)
+	}
+
+	// A posted score does
+	changed := games()
+	changed[0].VisitingScore, changed[0].HomeScore = "1", "3"
+	saveScrape(t, store, "4153", changed, now)
+	w := get(etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("got %d with ETag %s after a score was posted, want a new calendar", w.Code, w.Header().Get("ETag"))
+	}
+	if w.Header().Get("Last-Modified") == first.Header().Get("Last-Modified") {
+		t.Errorf("Last-Modified didn't change")
+	}
+}
+
+func TestEmptyTeamFeedIsStampedNow(t *testing.T) {
+
+	store := openTestStore(t)
+	if err := upsertTeam(store.db, team{ID: "4151", Name: "Heat FC"}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	w := httptest.NewRecorder()
+	(&feedServer{store: store}).teamFeed(w, httptest.NewRequest("GET", "/teams/4151.ics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", w.Code)
+	}
+	modified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if err != nil || modified.Before(before) {
+		t.Errorf("got Last-Modified %q, %v, want now", w.Header().Get("Last-Modified"), err)
+	}
+	if body := w.Body.String(); strings.Contains(body, "00010101") {
+		t.Errorf("the feed has a zero time in it\n%s", body)
+	}
+}
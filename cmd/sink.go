@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CalendarSink is a calendar the sync keeps in step with the schedule. A backend
+// only has to know how to list, write and remove events, reconcile works out
+// which event belongs to which game and what to call. Events are tagged with the
+// team they were synced for, so several teams can share a calendar.
+type CalendarSink interface {
+	// Name describes the calendar in logs and plans
+	Name() string
+	// List returns the events the sync put in the calendar for the team, each
+	// with its game key and ID. There may be more than one event for a game.
+	List(ctx context.Context, teamID string) ([]calendarEvent, error)
+	// Upsert creates the event if it has no ID, or replaces the event with its ID
+	Upsert(ctx context.Context, ev calendarEvent) error
+	// Delete removes the event with the ID of ev, deleting one that is already
+	// gone is not an error
+	Delete(ctx context.Context, ev calendarEvent) error
+	// Flush writes out any changes the sink buffers
+	Flush(ctx context.Context) error
+}
+
+// unbuffered is embedded by sinks that write every change as it is made, so have
+// nothing to flush
+type unbuffered struct{}
+
+func (unbuffered) Flush(ctx context.Context) error {
+	return nil
+}
+
+// calendarEvent is the event for a game, independent of any calendar backend
+type calendarEvent struct {
+	Key         string
+	ID          string // how the calendar refers to the event, empty until it is in one
+	Team        string // the team the event was synced for, empty in feeds
+	Summary     string
+	Location    string
+	Description string
+	Start       time.Time
+	End         time.Time
+	Sequence    int
+	Cancelled   bool
+}
+
+// newCalendarEvent returns the event for a game, with the summary the game is
+// described by
+func newCalendarEvent(g game, summary func(g game) string) calendarEvent {
+	return calendarEvent{
+		Key:         eventKey(g),
+		Summary:     summary(g),
+		Location:    g.Location,
+		Description: g.score(),
+		Start:       g.StartTime,
+		End:         g.StartTime.Add(gameDuration),
+		Sequence:    g.Sequence,
+		Cancelled:   g.Cancelled,
+	}
+}
+
+// syncPlan is what a sync would change in a calendar, so it can be reviewed
+// before it is applied
+type syncPlan struct {
+	Calendar string       `json:"calendar"`
+	Actions  []syncAction `json:"actions"`
+}
+
+// syncAction is a single change to a calendar
+type syncAction struct {
+	Op      string      `json:"op"` // insert, patch or delete
+	GameKey string      `json:"game_key"`
+	Summary string      `json:"summary"`
+	Diffs   []fieldDiff `json:"diffs,omitempty"`
+
+	event calendarEvent // the event to insert, patch with or delete
+}
+
+// fieldDiff is a field of an event whose value changes
+type fieldDiff struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// count returns how many actions of the plan are op
+func (p syncPlan) count(op string) int {
+	n := 0
+	for _, a := range p.Actions {
+		if a.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// reconcile makes the team's events in the calendar match its games: every game
+// gets an event, the events that no longer match their game are replaced, and the
+// events of games of the season that were cancelled or are no longer scheduled
+// are deleted. Events of other teams and of other seasons are left alone. With
+// dryRun the plan is worked out but nothing is changed.
+func reconcile(ctx context.Context, sink CalendarSink, teamID string, seasonID string, games []game, dryRun bool) (syncPlan, error) {
+
+	existing, err := sink.List(ctx, teamID)
+	if err != nil {
+		return syncPlan{}, err
+	}
+	var want []calendarEvent
+	for _, g := range games {
+		if !g.Cancelled {
+			ev := newCalendarEvent(g, teamSummary(teamID))
+			ev.Team = teamID
+			want = append(want, ev)
+		}
+	}
+	plan := planSync(sink.Name(), seasonID, existing, want)
+	if dryRun {
+		return plan, nil
+	}
+	if err := applySync(ctx, sink, plan); err != nil {
+		return plan, err
+	}
+
+	log.Infof("Synced calendar %s: %d inserted, %d patched, %d deleted",
+		plan.Calendar, plan.count("insert"), plan.count("patch"), plan.count("delete"))
+	return plan, nil
+}
+
+// planSync works out the actions that make the existing events match the wanted
+// ones of the season. The first event listed for a game is kept and any others
+// are deleted, as are the events of games of the season that aren't wanted.
+// Events of earlier seasons stay, their games are no longer scraped. Deletions
+// come last and are sorted by game key so the plan reads the same every time.
+func planSync(name string, seasonID string, existing []calendarEvent, want []calendarEvent) syncPlan {
+
+	plan := syncPlan{Calendar: name, Actions: []syncAction{}}
+	remaining := make(map[string]calendarEvent, len(existing))
+	var extra []calendarEvent
+	for _, ev := range existing {
+		if _, ok := remaining[ev.Key]; ok {
+			extra = append(extra, ev)
+			continue
+		}
+		remaining[ev.Key] = ev
+	}
+
+	wanted := make(map[string]bool, len(want))
+	for _, ev := range want {
+		wanted[ev.Key] = true
+		have, ok := remaining[ev.Key]
+		if !ok {
+			plan.Actions = append(plan.Actions, syncAction{
+				Op:      "insert",
+				GameKey: ev.Key,
+				Summary: ev.Summary,
+				Diffs:   eventDiff(calendarEvent{}, ev),
+				event:   ev,
+			})
+			continue
+		}
+		delete(remaining, ev.Key)
+		diffs := eventDiff(have, ev)
+		if len(diffs) == 0 {
+			continue
+		}
+		ev.ID = have.ID
+		plan.Actions = append(plan.Actions, syncAction{
+			Op:      "patch",
+			GameKey: ev.Key,
+			Summary: ev.Summary,
+			Diffs:   diffs,
+			event:   ev,
+		})
+	}
+
+	// Anything left is for a game that was cancelled or has gone from the
+	// schedule, or is another event for a game that already has one
+	for _, ev := range remaining {
+		extra = append(extra, ev)
+	}
+	sort.Slice(extra, func(i, j int) bool {
+		if extra[i].Key != extra[j].Key {
+			return extra[i].Key < extra[j].Key
+		}
+		return extra[i].ID < extra[j].ID
+	})
+	for _, ev := range extra {
+		if !wanted[ev.Key] && !strings.HasPrefix(ev.Key, seasonID+"-") {
+			continue
+		}
+		plan.Actions = append(plan.Actions, syncAction{
+			Op:      "delete",
+			GameKey: ev.Key,
+			Summary: ev.Summary,
+			event:   ev,
+		})
+	}
+	return plan
+}
+
+// forTeam reports whether an event listed by a sink is the team's. Events synced
+// before they were tagged with their team belong to the teams their game key
+// names.
+func forTeam(ev calendarEvent, teamID string) bool {
+	if ev.Team != "" {
+		return ev.Team == teamID
+	}
+	for _, id := range strings.Split(ev.Key, "-") {
+		if id == teamID {
+			return true
+		}
+	}
+	return false
+}
+
+// applySync carries out the actions of the plan in order, then flushes the sink
+func applySync(ctx context.Context, sink CalendarSink, plan syncPlan) error {
+
+	for _, a := range plan.Actions {
+		var err error
+		switch a.Op {
+		case "insert", "patch":
+			err = sink.Upsert(ctx, a.event)
+		case "delete":
+			err = sink.Delete(ctx, a.event)
+		}
+		if err != nil {
+			return fmt.Errorf("error applying %s of %s to %s, %v", a.Op, a.GameKey, sink.Name(), err)
+		}
+	}
+	if err := sink.Flush(ctx); err != nil {
+		return fmt.Errorf("error writing %s, %v", sink.Name(), err)
+	}
+	return nil
+}
+
+// eventDiff returns the fields of an existing event that differ from the wanted
+// one, none if it doesn't need to be changed. Times are compared as instants.
+func eventDiff(have calendarEvent, want calendarEvent) []fieldDiff {
+	var diffs []fieldDiff
+	for _, f := range []struct {
+		name       string
+		have, want string
+	}{
+		{"summary", have.Summary, want.Summary},
+		{"location", have.Location, want.Location},
+		{"description", have.Description, want.Description},
+	} {
+		if f.have != f.want {
+			diffs = append(diffs, fieldDiff{f.name, f.have, f.want})
+		}
+	}
+	if !have.Start.Equal(want.Start) {
+		diffs = append(diffs, fieldDiff{"start", eventTimeString(have.Start), eventTimeString(want.Start)})
+	}
+	if !have.End.Equal(want.End) {
+		diffs = append(diffs, fieldDiff{"end", eventTimeString(have.End), eventTimeString(want.End)})
+	}
+	if have.Team != want.Team {
+		diffs = append(diffs, fieldDiff{"team", have.Team, want.Team})
+	}
+	return diffs
+}
+
+// eventTimeString formats an event time in the league time zone
+func eventTimeString(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(leagueLocation).Format(changeTimeLayout)
+}
+
+// printSyncPlan writes the plan as text for people or as JSON for scripts
+func printSyncPlan(w io.Writer, plan syncPlan, format string) error {
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+
+	fmt.Fprintf(w, "Plan for calendar %s: %d to insert, %d to patch, %d to delete\n",
+		plan.Calendar, plan.count("insert"), plan.count("patch"), plan.count("delete"))
+	for _, a := range plan.Actions {
+		fmt.Fprintf(w, "\n%s %s  %s\n", a.Op, a.GameKey, a.Summary)
+		for _, d := range a.Diffs {
+			if d.Before != "" {
+				fmt.Fprintf(w, "  - %s: %s\n", d.Field, strings.Replace(d.Before, "\n", " ", -1))
+			}
+			if d.After != "" {
+				fmt.Fprintf(w, "  + %s: %s\n", d.Field, strings.Replace(d.After, "\n", " ", -1))
+			}
+		}
+	}
+	return nil
+}
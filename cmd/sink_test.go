@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// planOps returns each action of the plan as its op and game key
+func planOps(plan syncPlan) []string {
+	var ops []string
+	for _, a := range plan.Actions {
+		ops = append(ops, a.Op+" "+a.GameKey)
+	}
+	return ops
+}
+
+func TestPlanSync(t *testing.T) {
+
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	event := func(key string, id string, start time.Time) calendarEvent {
+		return calendarEvent{Key: key, ID: id, Summary: "Megpies FC vs " + key, Start: start, End: start.Add(gameDuration)}
+	}
+
+	existing := []calendarEvent{
+		event("733-unchanged", "1", kickoff),
+		event("733-moved", "2", kickoff),
+		event("733-gone", "3", kickoff),
+		event("733-unchanged", "4", kickoff),
+		event("733-moved", "5", kickoff),
+	}
+	want := []calendarEvent{
+		event("733-new", "", kickoff),
+		event("733-unchanged", "", kickoff),
+		event("733-moved", "", kickoff.Add(time.Hour)),
+	}
+
+	plan := planSync("test", "733", existing, want)
+	got := planOps(plan)
+	wantOps := []string{"insert 733-new", "patch 733-moved", "delete 733-gone", "delete 733-moved", "delete 733-unchanged"}
+	if strings.Join(got, ", ") != strings.Join(wantOps, ", ") {
+		t.Fatalf("got plan %v, want %v", got, wantOps)
+	}
+
+	ids := make(map[string]string)
+	for _, a := range plan.Actions {
+		ids[a.Op+" "+a.GameKey] = a.event.ID
+	}
+	if ids["insert 733-new"] != "" || ids["patch 733-moved"] != "2" || ids["delete 733-moved"] != "5" || ids["delete 733-unchanged"] != "4" {
+		t.Errorf("the first event of each game must be kept, got IDs %v", ids)
+	}
+	if d := plan.Actions[1].Diffs; len(d) != 2 || d[0].Field != "start" || d[1].Field != "end" {
+		t.Errorf("got diffs %v, want start and end", d)
+	}
+}
+
+func TestPlanSyncKeepsEarlierSeasons(t *testing.T) {
+
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	lastSeason := calendarEvent{Key: "724-483-4150-4153-1", ID: "1", Team: "4153", Start: kickoff.AddDate(0, -3, 0)}
+	gone := calendarEvent{Key: "733-483-4150-4153-1", ID: "2", Team: "4153", Start: kickoff}
+
+	// A new season with no games yet only deletes the events of its own games
+	plan := planSync("test", "733", []calendarEvent{lastSeason, gone}, nil)
+	if got := planOps(plan); len(got) != 1 || got[0] != "delete 733-483-4150-4153-1" {
+		t.Errorf("got plan %v, want only the game of the season deleted", got)
+	}
+}
+
+func TestReconcileDryRunChangesNothing(t *testing.T) {
+
+	var out bytes.Buffer
+	sink := newICSWriterSink(&out, "test")
+	games := []game{testGame(time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation), "4150", "4153")}
+	assignGameKeys(nil, games, time.Time{})
+
+	plan, err := reconcile(context.Background(), sink, "4153", "733", games, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != 1 || plan.Actions[0].Op != "insert" {
+		t.Fatalf("got plan %v, want a single insert", planOps(plan))
+	}
+	if out.Len() != 0 || len(sink.events) != 0 {
+		t.Errorf("a dry run wrote to the sink")
+	}
+
+	var text bytes.Buffer
+	if err := printSyncPlan(&text, plan, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "+ summary: Megpies FC vs Degenerates FC (Home)") {
+		t.Errorf("got plan text:\n%s", text.String())
+	}
+}
+
+func TestReconcileTeamsSharingACalendar(t *testing.T) {
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "shared.ics")
+	kickoff := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	games := []game{
+		testGame(kickoff, "4150", "4153"),
+		testGame(kickoff.AddDate(0, 0, 7), "4153", "4152"),
+	}
+	assignGameKeys(nil, games, time.Time{})
+
+	// An event synced for 4153 before events were tagged with their team
+	legacy := newCalendarEvent(games[0], teamSummary("4153"))
+	var buf bytes.Buffer
+	if err := writeEvents(&buf, "shared", []calendarEvent{legacy}, kickoff); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := reconcile(ctx, newICSFileSink(path, "shared"), "4153", "733", games, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ops := strings.Join(planOps(plan), ", "); ops != "patch 733-483-4150-4153-1, insert 733-483-4152-4153-1" {
+		t.Fatalf("got plan %s, want the legacy event tagged and the other game inserted", ops)
+	}
+
+	// 4150 plays the first game too, and gets an event of its own for it
+	plan, err = reconcile(ctx, newICSFileSink(path, "shared"), "4150", "733", games[:1], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ops := strings.Join(planOps(plan), ", "); ops != "insert 733-483-4150-4153-1" {
+		t.Fatalf("got plan %s, want only an insert", ops)
+	}
+
+	// Syncing 4153 again leaves the events of 4150 alone
+	plan, err = reconcile(ctx, newICSFileSink(path, "shared"), "4153", "733", games, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != 0 {
+		t.Fatalf("got plan %v, want nothing to do", planOps(plan))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := readEvents(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ev := range events {
+		names = append(names, eventName(ev)+" "+ev.Summary)
+	}
+	want := []string{
+		"733-483-4150-4153-1+4150 Degenerates FC vs Megpies FC (Away)",
+		"733-483-4150-4153-1+4153 Megpies FC vs Degenerates FC (Home)",
+		"733-483-4152-4153-1+4153 Megpies FC vs Croatia U21 (Away)",
+	}
+	if strings.Join(names, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got events\n%s\nwant\n%s", strings.Join(names, "\n"), strings.Join(want, "\n"))
+	}
+}
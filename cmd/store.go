@@ -0,0 +1,729 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite" // pure-Go SQLite driver, registered as "sqlite"
+)
+
+// migrations are applied in order to bring a database up to the latest schema. The
+// version of a migration is its index plus one, and the version of the database is
+// kept in the schema_migrations table.
+//
+// Never edit or reorder a migration that has been released, append a new one instead.
+var migrations = []string{
+	// 1: seasons, divisions, teams, games and scrape runs
+	`
+	CREATE TABLE seasons (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL
+	);
+
+	CREATE TABLE divisions (
+		id         TEXT PRIMARY KEY,
+		season_id  TEXT NOT NULL DEFAULT '',
+		name       TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL
+	);
+
+	CREATE TABLE teams (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		division_id TEXT NOT NULL DEFAULT '',
+		updated_at  TEXT NOT NULL
+	);
+
+	CREATE TABLE games (
+		id               INTEGER PRIMARY KEY AUTOINCREMENT,
+		season_id        TEXT NOT NULL,
+		division_id      TEXT NOT NULL DEFAULT '',
+		start_time       TEXT NOT NULL,
+		visiting_team_id TEXT NOT NULL,
+		visiting_score   TEXT NOT NULL DEFAULT '',
+		home_team_id     TEXT NOT NULL,
+		home_score       TEXT NOT NULL DEFAULT '',
+		event            TEXT NOT NULL DEFAULT '',
+		location         TEXT NOT NULL DEFAULT '',
+		first_seen_at    TEXT NOT NULL,
+		updated_at       TEXT NOT NULL,
+		UNIQUE (season_id, start_time, visiting_team_id, home_team_id)
+	);
+
+	CREATE INDEX games_home_team ON games (season_id, home_team_id);
+	CREATE INDEX games_visiting_team ON games (season_id, visiting_team_id);
+
+	CREATE TABLE scrape_runs (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		team_name   TEXT NOT NULL,
+		team_id     TEXT NOT NULL DEFAULT '',
+		season_id   TEXT NOT NULL DEFAULT '',
+		started_at  TEXT NOT NULL,
+		finished_at TEXT NOT NULL DEFAULT '',
+		status      TEXT NOT NULL DEFAULT 'running',
+		games_found INTEGER NOT NULL DEFAULT 0,
+		error       TEXT NOT NULL DEFAULT ''
+	);
+	`,
+	// 2: cancelled games and the changes detected by each scrape run
+	`
+	ALTER TABLE games ADD COLUMN status TEXT NOT NULL DEFAULT 'scheduled';
+
+	CREATE TABLE changes (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id      INTEGER NOT NULL REFERENCES scrape_runs (id),
+		team_id     TEXT NOT NULL,
+		type        TEXT NOT NULL,
+		change      TEXT NOT NULL,
+		detected_at TEXT NOT NULL
+	);
+
+	CREATE INDEX changes_team ON changes (team_id, detected_at);
+	`,
+	// 3: identity keys that follow a game when it is rescheduled
+	`
+	ALTER TABLE games ADD COLUMN game_key TEXT NOT NULL DEFAULT '';
+
+	CREATE UNIQUE INDEX games_key ON games (game_key) WHERE game_key != '';
+	`,
+	// 4: email digests that have been sent
+	`
+	CREATE TABLE digests (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		team_id    TEXT NOT NULL,
+		recipients TEXT NOT NULL,
+		sent_at    TEXT NOT NULL
+	);
+
+	CREATE INDEX digests_team ON digests (team_id, sent_at);
+	`,
+	// 5: iCalendar sequence numbers, bumped whenever a game is rescheduled or cancelled
+	`
+	ALTER TABLE games ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0;
+	`,
+	// 6: how many changes each run found, and how syncing them to a calendar went
+	`
+	ALTER TABLE scrape_runs ADD COLUMN changes_found INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE scrape_runs ADD COLUMN sync_status TEXT NOT NULL DEFAULT '';
+	ALTER TABLE scrape_runs ADD COLUMN events_synced INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE scrape_runs ADD COLUMN sync_error TEXT NOT NULL DEFAULT '';
+	`,
+}
+
+// Store persists the seasons, divisions, teams and games found by the scraper,
+// along with a record of every scrape run. It is shared by every command that
+// needs the schedule.
+type Store struct {
+	db *sql.DB
+}
+
+// season is a league season, identified by the value of the ddlSeason option
+type season struct {
+	ID   string
+	Name string
+}
+
+// division is a division of a season, identified by the `did` of the team links
+type division struct {
+	ID       string
+	SeasonID string
+	Name     string
+}
+
+// team is a team in a division, identified by the `tid` of the team links
+type team struct {
+	ID         string
+	Name       string
+	DivisionID string
+}
+
+// scrapeRun is a record of a single run of the scraper
+type scrapeRun struct {
+	ID         int64
+	TeamName   string
+	TeamID     string
+	SeasonID   string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Status     string // running, ok or failed
+	GamesFound int
+	Error      string
+
+	ChangesFound int
+	SyncStatus   string // empty if the run wasn't synced, otherwise ok or failed
+	EventsSynced int    // events inserted, patched or deleted
+	SyncError    string
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// timeFormat is how times are stored, it sorts lexically in chronological order
+// as long as every time is stored in UTC
+const timeFormat = time.RFC3339
+
+// OpenStore opens the SQLite database at path, creating it if needed, and
+// migrates it to the latest schema
+func OpenStore(path string) (*Store, error) {
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening store %s, %v", path, err)
+	}
+	// SQLite only supports a single writer
+	db.SetMaxOpenConns(1)
+
+	s := &Store{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies every migration newer than the version of the database
+func (s *Store) migrate() error {
+
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations, %v", err)
+	}
+
+	var version int
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("error reading schema version, %v", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		log.Debugf("migrate: applying migration %d", i+1)
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error applying migration %d, %v", i+1, err)
+		}
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+			i+1, formatTime(time.Now()))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error recording migration %d, %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing migration %d, %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// UpsertSeason inserts or updates a season
+func (s *Store) UpsertSeason(se season) error {
+	return upsertSeason(s.db, se)
+}
+
+// UpsertDivision inserts or updates a division
+func (s *Store) UpsertDivision(d division) error {
+	return upsertDivision(s.db, d)
+}
+
+// UpsertTeam inserts or updates a team
+func (s *Store) UpsertTeam(t team) error {
+	return upsertTeam(s.db, t)
+}
+
+// UpsertGame inserts or updates a game, along with its teams and division
+func (s *Store) UpsertGame(g game) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return upsertGame(tx, g)
+	})
+}
+
+// SaveSchedule stores the season, divisions, teams and games of a scrape, along
+// with the changes detected against the previously stored schedule, in a single
+// transaction. Games that moved are updated in place and removed games are marked
+// as cancelled rather than deleted.
+func (s *Store) SaveSchedule(runID int64, result scrapeResult, changes []change) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if err := upsertSeason(tx, season{ID: result.SeasonID}); err != nil {
+			return err
+		}
+		for _, g := range result.Games {
+			if err := backfillGameKey(tx, g); err != nil {
+				return err
+			}
+		}
+		for _, c := range changes {
+			if err := applyChange(tx, c); err != nil {
+				return err
+			}
+		}
+		for _, g := range result.Games {
+			if err := upsertGame(tx, g); err != nil {
+				return err
+			}
+		}
+		return insertChanges(tx, runID, changes)
+	})
+}
+
+// Games returns the scheduled games of a season the team plays in, ordered by
+// start time
+func (s *Store) Games(seasonID string, teamID string) ([]game, error) {
+	return s.queryGames(`WHERE g.season_id = ? AND (g.home_team_id = ? OR g.visiting_team_id = ?)
+		AND g.status = 'scheduled'
+		ORDER BY g.start_time`, seasonID, teamID, teamID)
+}
+
+// CalendarGames returns every game of a season the team plays in, cancelled games
+// included, ordered by start time
+func (s *Store) CalendarGames(seasonID string, teamID string) ([]game, error) {
+	return s.queryGames(`WHERE g.season_id = ? AND (g.home_team_id = ? OR g.visiting_team_id = ?)
+		ORDER BY g.start_time`, seasonID, teamID, teamID)
+}
+
+// TeamCalendarGames returns every game the team plays in, from every season and
+// cancelled games included, along with when any of them last changed
+func (s *Store) TeamCalendarGames(teamID string) ([]game, time.Time, error) {
+	where := `WHERE g.home_team_id = ? OR g.visiting_team_id = ?`
+	return s.calendarGames(where, teamID, teamID)
+}
+
+// DivisionCalendarGames returns every game played in the division, cancelled
+// games included, along with when any of them last changed
+func (s *Store) DivisionCalendarGames(divisionID string) ([]game, time.Time, error) {
+	return s.calendarGames(`WHERE g.division_id = ?`, divisionID)
+}
+
+func (s *Store) calendarGames(where string, args ...interface{}) ([]game, time.Time, error) {
+
+	var updatedAt string
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(g.updated_at), '') FROM games g `+where, args...).Scan(&updatedAt)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error querying games, %v", err)
+	}
+	games, err := s.queryGames(where+` ORDER BY g.start_time`, args...)
+	return games, parseTime(updatedAt), err
+}
+
+// Division returns the division with the given ID
+func (s *Store) Division(divisionID string) (division, error) {
+	var d division
+	err := s.db.QueryRow(`SELECT id, season_id, name FROM divisions WHERE id = ?`, divisionID).
+		Scan(&d.ID, &d.SeasonID, &d.Name)
+	if err == sql.ErrNoRows {
+		return d, fmt.Errorf("No division found with ID %s", divisionID)
+	}
+	return d, err
+}
+
+// Changes returns the changes to the team's schedule detected since the given
+// time, oldest first
+func (s *Store) Changes(teamID string, since time.Time) ([]change, error) {
+
+	rows, err := s.db.Query(`SELECT change FROM changes WHERE team_id = ? AND detected_at >= ?
+		ORDER BY id`, teamID, formatTime(since))
+	if err != nil {
+		return nil, fmt.Errorf("error querying changes, %v", err)
+	}
+	defer rows.Close()
+
+	var changes []change
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, fmt.Errorf("error reading change, %v", err)
+		}
+		var c change
+		if err := json.Unmarshal([]byte(raw), &c); err != nil {
+			return nil, fmt.Errorf("error decoding change, %v", err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// UpcomingGames returns the scheduled games the team plays between from and to,
+// ordered by start time
+func (s *Store) UpcomingGames(teamID string, from time.Time, to time.Time) ([]game, error) {
+	return s.queryGames(`WHERE (g.home_team_id = ? OR g.visiting_team_id = ?)
+		AND g.start_time >= ? AND g.start_time < ? AND g.status = 'scheduled'
+		ORDER BY g.start_time`, teamID, teamID, formatTime(from), formatTime(to))
+}
+
+// TeamByName returns the team with the given name
+func (s *Store) TeamByName(name string) (team, error) {
+	var t team
+	err := s.db.QueryRow(`SELECT id, name, division_id FROM teams WHERE name = ? ORDER BY updated_at DESC LIMIT 1`, name).
+		Scan(&t.ID, &t.Name, &t.DivisionID)
+	if err == sql.ErrNoRows {
+		return t, fmt.Errorf("No team found matching %s, has it been scraped yet?", name)
+	}
+	return t, err
+}
+
+// TeamByRef returns the team by its ID if the reference has one, by name if not
+func (s *Store) TeamByRef(ref teamRef) (team, error) {
+	if ref.ID != "" {
+		return s.Team(ref.ID)
+	}
+	return s.TeamByName(ref.Name)
+}
+
+// Team returns the team with the given ID
+func (s *Store) Team(teamID string) (team, error) {
+	var t team
+	err := s.db.QueryRow(`SELECT id, name, division_id FROM teams WHERE id = ?`, teamID).
+		Scan(&t.ID, &t.Name, &t.DivisionID)
+	if err == sql.ErrNoRows {
+		return t, fmt.Errorf("No team found with ID %s", teamID)
+	}
+	return t, err
+}
+
+// StartRun records the start of a scrape run and returns its ID
+func (s *Store) StartRun(teamName string) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO scrape_runs (team_name, started_at) VALUES (?, ?)`,
+		teamName, formatTime(time.Now()))
+	if err != nil {
+		return 0, fmt.Errorf("error starting scrape run, %v", err)
+	}
+	return res.LastInsertId()
+}
+
+// FinishRun records the outcome of a scrape run. A non-nil runErr marks the run
+// as failed.
+func (s *Store) FinishRun(runID int64, result scrapeResult, changes []change, runErr error) error {
+	status, errText := "ok", ""
+	if runErr != nil {
+		status, errText = "failed", runErr.Error()
+	}
+	_, err := s.db.Exec(`UPDATE scrape_runs
+		SET team_id = ?, season_id = ?, finished_at = ?, status = ?, games_found = ?, error = ?,
+			changes_found = ?
+		WHERE id = ?`,
+		result.TeamID, result.SeasonID, formatTime(time.Now()), status, len(result.Games), errText,
+		len(changes), runID)
+	if err != nil {
+		return fmt.Errorf("error finishing scrape run %d, %v", runID, err)
+	}
+	return nil
+}
+
+// RecordSync records how syncing the games of a scrape run to a calendar went.
+// A non-nil syncErr marks the sync as failed.
+func (s *Store) RecordSync(runID int64, plan syncPlan, syncErr error) error {
+	status, errText := "ok", ""
+	if syncErr != nil {
+		status, errText = "failed", syncErr.Error()
+	}
+	_, err := s.db.Exec(`UPDATE scrape_runs
+		SET finished_at = ?, sync_status = ?, events_synced = ?, sync_error = ?
+		WHERE id = ?`,
+		formatTime(time.Now()), status, len(plan.Actions), errText, runID)
+	if err != nil {
+		return fmt.Errorf("error recording sync of scrape run %d, %v", runID, err)
+	}
+	return nil
+}
+
+// LastRun returns the most recent scrape run for the named team
+func (s *Store) LastRun(teamName string) (scrapeRun, error) {
+	var run scrapeRun
+	var startedAt, finishedAt string
+	err := s.db.QueryRow(`SELECT id, team_name, team_id, season_id, started_at, finished_at,
+		status, games_found, error, changes_found, sync_status, events_synced, sync_error
+		FROM scrape_runs WHERE team_name = ? ORDER BY id DESC LIMIT 1`, teamName).
+		Scan(&run.ID, &run.TeamName, &run.TeamID, &run.SeasonID, &startedAt, &finishedAt,
+			&run.Status, &run.GamesFound, &run.Error, &run.ChangesFound, &run.SyncStatus,
+			&run.EventsSynced, &run.SyncError)
+	if err != nil {
+		return run, err
+	}
+	run.StartedAt = parseTime(startedAt)
+	run.FinishedAt = parseTime(finishedAt)
+	return run, nil
+}
+
+// LastDigest returns when a digest for the team was last sent, or the zero time
+// if one never has been
+func (s *Store) LastDigest(teamID string) (time.Time, error) {
+	var sentAt string
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(sent_at), '') FROM digests WHERE team_id = ?`, teamID).Scan(&sentAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading last digest, %v", err)
+	}
+	return parseTime(sentAt), nil
+}
+
+// RecordDigest records that a digest for the team was sent to the recipients
+func (s *Store) RecordDigest(teamID string, recipients []string, sentAt time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO digests (team_id, recipients, sent_at) VALUES (?, ?, ?)`,
+		teamID, strings.Join(recipients, ","), formatTime(sentAt))
+	if err != nil {
+		return fmt.Errorf("error recording digest, %v", err)
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, committing if it succeeds and rolling back if not
+func (s *Store) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryGames selects games along with the names of their teams. The where clause
+// may refer to the games table as g.
+func (s *Store) queryGames(where string, args ...interface{}) ([]game, error) {
+
+	rows, err := s.db.Query(`SELECT g.game_key, g.season_id, g.division_id, g.start_time,
+		g.visiting_team_id, COALESCE(v.name, ''), g.visiting_score,
+		g.home_team_id, COALESCE(h.name, ''), g.home_score,
+		g.event, g.location, g.status, g.sequence
+		FROM games g
+		LEFT JOIN teams v ON v.id = g.visiting_team_id
+		LEFT JOIN teams h ON h.id = g.home_team_id
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying games, %v", err)
+	}
+	defer rows.Close()
+
+	var games []game
+	for rows.Next() {
+		var g game
+		var startTime, status string
+		err := rows.Scan(&g.Key, &g.SeasonID, &g.DivisionID, &startTime,
+			&g.VisitingTeamID, &g.VisitingTeam, &g.VisitingScore,
+			&g.HomeTeamID, &g.HomeTeam, &g.HomeScore,
+			&g.Event, &g.Location, &status, &g.Sequence)
+		if err != nil {
+			return nil, fmt.Errorf("error reading game, %v", err)
+		}
+		g.StartTime = parseTime(startTime).In(leagueLocation)
+		g.Cancelled = status == "cancelled"
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
+func upsertSeason(ex execer, se season) error {
+	_, err := ex.Exec(`INSERT INTO seasons (id, name, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = COALESCE(NULLIF(excluded.name, ''), seasons.name),
+			updated_at = excluded.updated_at`,
+		se.ID, se.Name, formatTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error saving season %s, %v", se.ID, err)
+	}
+	return nil
+}
+
+func upsertDivision(ex execer, d division) error {
+	_, err := ex.Exec(`INSERT INTO divisions (id, season_id, name, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			season_id = COALESCE(NULLIF(excluded.season_id, ''), divisions.season_id),
+			name = COALESCE(NULLIF(excluded.name, ''), divisions.name),
+			updated_at = excluded.updated_at`,
+		d.ID, d.SeasonID, d.Name, formatTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error saving division %s, %v", d.ID, err)
+	}
+	return nil
+}
+
+func upsertTeam(ex execer, t team) error {
+	_, err := ex.Exec(`INSERT INTO teams (id, name, division_id, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name,
+			division_id = COALESCE(NULLIF(excluded.division_id, ''), teams.division_id),
+			updated_at = excluded.updated_at`,
+		t.ID, t.Name, t.DivisionID, formatTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error saving team %s, %v", t.ID, err)
+	}
+	return nil
+}
+
+// upsertGame inserts or updates a game, along with its teams and division. The
+// game's updated_at is only bumped when something stored about it changes, so
+// the feeds only look modified when the schedule is.
+func upsertGame(ex execer, g game) error {
+
+	if g.DivisionID != "" {
+		if err := upsertDivision(ex, division{ID: g.DivisionID, SeasonID: g.SeasonID}); err != nil {
+			return err
+		}
+	}
+	if err := upsertTeam(ex, team{ID: g.VisitingTeamID, Name: g.VisitingTeam, DivisionID: g.DivisionID}); err != nil {
+		return err
+	}
+	if err := upsertTeam(ex, team{ID: g.HomeTeamID, Name: g.HomeTeam, DivisionID: g.DivisionID}); err != nil {
+		return err
+	}
+
+	now := formatTime(time.Now())
+	var err error
+	if g.Key == "" {
+		_, err = ex.Exec(`INSERT INTO games (season_id, division_id, start_time,
+				visiting_team_id, visiting_score, home_team_id, home_score,
+				event, location, first_seen_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (season_id, start_time, visiting_team_id, home_team_id) DO UPDATE SET
+				division_id = excluded.division_id,
+				visiting_score = excluded.visiting_score,
+				home_score = excluded.home_score,
+				event = excluded.event,
+				location = excluded.location,
+				status = 'scheduled',
+				updated_at = excluded.updated_at
+			WHERE games.division_id IS NOT excluded.division_id
+				OR games.visiting_score IS NOT excluded.visiting_score
+				OR games.home_score IS NOT excluded.home_score
+				OR games.event IS NOT excluded.event
+				OR games.location IS NOT excluded.location
+				OR games.status != 'scheduled'`,
+			g.SeasonID, g.DivisionID, formatTime(g.StartTime),
+			g.VisitingTeamID, g.VisitingScore, g.HomeTeamID, g.HomeScore,
+			g.Event, g.Location, now, now)
+	} else {
+		_, err = ex.Exec(`INSERT INTO games (game_key, season_id, division_id, start_time,
+				visiting_team_id, visiting_score, home_team_id, home_score,
+				event, location, first_seen_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (game_key) WHERE game_key != '' DO UPDATE SET
+				start_time = excluded.start_time,
+				visiting_team_id = excluded.visiting_team_id,
+				home_team_id = excluded.home_team_id,
+				visiting_score = excluded.visiting_score,
+				home_score = excluded.home_score,
+				event = excluded.event,
+				location = excluded.location,
+				status = 'scheduled',
+				updated_at = excluded.updated_at
+			WHERE games.start_time IS NOT excluded.start_time
+				OR games.visiting_team_id IS NOT excluded.visiting_team_id
+				OR games.home_team_id IS NOT excluded.home_team_id
+				OR games.visiting_score IS NOT excluded.visiting_score
+				OR games.home_score IS NOT excluded.home_score
+				OR games.event IS NOT excluded.event
+				OR games.location IS NOT excluded.location
+				OR games.status != 'scheduled'`,
+			g.Key, g.SeasonID, g.DivisionID, formatTime(g.StartTime),
+			g.VisitingTeamID, g.VisitingScore, g.HomeTeamID, g.HomeScore,
+			g.Event, g.Location, now, now)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving game %s vs %s at %v, %v", g.VisitingTeam, g.HomeTeam, g.StartTime, err)
+	}
+	return nil
+}
+
+// applyChange moves a stored game to where the change says it is now, so that it
+// keeps its row when it is rescheduled, or marks it cancelled if it was removed
+func applyChange(ex execer, c change) error {
+
+	if c.Before == nil {
+		return nil
+	}
+	b := c.Before
+	where, args := gameRow(*b)
+
+	var err error
+	if c.After == nil {
+		_, err = ex.Exec(`UPDATE games SET status = 'cancelled', sequence = sequence + 1, updated_at = ? `+where,
+			append([]interface{}{formatTime(time.Now())}, args...)...)
+	} else {
+		// A fixture with several changes is moved by the first one, the rest
+		// either match no rows or leave the start time as it is
+		a := c.After
+		_, err = ex.Exec(`UPDATE games SET game_key = ?, start_time = ?, visiting_team_id = ?, home_team_id = ?,
+			sequence = sequence + (start_time != ?), updated_at = ? `+where,
+			append([]interface{}{a.Key, formatTime(a.StartTime), a.VisitingTeamID, a.HomeTeamID,
+				formatTime(a.StartTime), formatTime(time.Now())}, args...)...)
+	}
+	if err != nil {
+		return fmt.Errorf("error applying %s change to %s vs %s, %v", c.Type, b.VisitingTeam, b.HomeTeam, err)
+	}
+	return nil
+}
+
+// gameRow returns the where clause matching the stored row of a game, by its key
+// if it has one
+func gameRow(g game) (string, []interface{}) {
+	if g.Key != "" {
+		return `WHERE game_key = ?`, []interface{}{g.Key}
+	}
+	return `WHERE season_id = ? AND start_time = ? AND visiting_team_id = ? AND home_team_id = ?`,
+		[]interface{}{g.SeasonID, formatTime(g.StartTime), g.VisitingTeamID, g.HomeTeamID}
+}
+
+// backfillGameKey sets the key of a game stored before games had keys
+func backfillGameKey(ex execer, g game) error {
+	if g.Key == "" {
+		return nil
+	}
+	_, err := ex.Exec(`UPDATE games SET game_key = ?
+		WHERE season_id = ? AND start_time = ? AND visiting_team_id = ? AND home_team_id = ? AND game_key = ''`,
+		g.Key, g.SeasonID, formatTime(g.StartTime), g.VisitingTeamID, g.HomeTeamID)
+	if err != nil {
+		return fmt.Errorf("error setting key of game %s, %v", g.Key, err)
+	}
+	return nil
+}
+
+func insertChanges(ex execer, runID int64, changes []change) error {
+	now := formatTime(time.Now())
+	for _, c := range changes {
+		raw, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		_, err = ex.Exec(`INSERT INTO changes (run_id, team_id, type, change, detected_at) VALUES (?, ?, ?, ?, ?)`,
+			runID, c.TeamID, string(c.Type), string(raw), now)
+		if err != nil {
+			return fmt.Errorf("error saving change, %v", err)
+		}
+	}
+	return nil
+}
+
+// formatTime formats t for storage
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(timeFormat)
+}
+
+// parseTime parses a stored time, returning the zero time if it was never set
+func parseTime(s string) time.Time {
+	t, err := time.Parse(timeFormat, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
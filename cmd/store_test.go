@@ -0,0 +1,104 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestStore opens an empty store that is removed when the test ends
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := OpenStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testGame is a game of season 733 division 483 at the given time
+func testGame(start time.Time, visitingID string, homeID string) game {
+	names := map[string]string{"4150": "Degenerates FC", "4152": "Croatia U21", "4153": "Megpies FC"}
+	return game{
+		SeasonID:       "733",
+		DivisionID:     "483",
+		StartTime:      start,
+		VisitingTeamID: visitingID,
+		VisitingTeam:   names[visitingID],
+		HomeTeamID:     homeID,
+		HomeTeam:       names[homeID],
+		Event:          "Soccer",
+		Location:       "Burnaby Indoor Soccer Centre",
+	}
+}
+
+// saveScrape saves a scrape of the team's games the way scrapeAndCompare does and
+// returns the changes it found
+func saveScrape(t *testing.T, store *Store, teamID string, games []game, now time.Time) []change {
+	t.Helper()
+	stored, err := store.CalendarGames("733", teamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, err := store.Games("733", teamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignGameKeys(stored, games, now)
+	changes := detectChanges(teamID, prev, games, now)
+	runID, err := store.StartRun(teamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := scrapeResult{SeasonID: "733", TeamID: teamID, Games: games}
+	if err := store.SaveSchedule(runID, result, changes); err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func TestSaveSchedule(t *testing.T) {
+
+	store := openTestStore(t)
+	now := time.Date(2019, time.September, 1, 12, 0, 0, 0, leagueLocation)
+	first := time.Date(2019, time.September, 12, 19, 0, 0, 0, leagueLocation)
+	second := first.AddDate(0, 0, 7)
+
+	changes := saveScrape(t, store, "4153", []game{
+		testGame(first, "4150", "4153"),
+		testGame(second, "4153", "4152"),
+	}, now)
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes on the first scrape, want 2 added", len(changes))
+	}
+
+	// The second game moves a day later and the first is dropped from the grid
+	moved := second.AddDate(0, 0, 1)
+	changes = saveScrape(t, store, "4153", []game{testGame(moved, "4153", "4152")}, now)
+	if len(changes) != 2 || changes[0].Type != changeRemoved || changes[1].Type != changeTimeMoved {
+		t.Fatalf("got changes %v, want removed and time_moved", changes)
+	}
+
+	games, err := store.CalendarGames("733", "4153")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 2 {
+		t.Fatalf("got %d stored games, want 2", len(games))
+	}
+	if !games[0].Cancelled || games[0].Key != "733-483-4150-4153-1" || games[0].Sequence != 1 {
+		t.Errorf("first game %+v, want it cancelled with sequence 1", games[0])
+	}
+	if games[1].Cancelled || !games[1].StartTime.Equal(moved) || games[1].Key != "733-483-4152-4153-1" || games[1].Sequence != 1 {
+		t.Errorf("second game %+v, want it moved in place with sequence 1", games[1])
+	}
+
+	stored, err := store.Changes("4153", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 4 {
+		t.Errorf("got %d stored changes, want 4", len(stored))
+	}
+}
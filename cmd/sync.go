@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syncCommand scrapes a team's schedule and makes the events in a calendar match
+// it. Games get an event each, events of cancelled games are deleted, and events
+// the sync didn't create are left alone. With a config file every team in it is
+// scraped once and synced to the sinks of every profile following it, unless -tn
+// or -sink say otherwise.
+func syncCommand(args []string) error {
+
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	var configPath = fs.String("config", "", configUsage)
+	var teamName = fs.String("tn", "Megpies FC", "Team name for which the schedule will be synced")
+	var profileName = fs.String("profile", "", "Only sync the teams of this profile of the config file, to its calendars")
+	var dbPath = fs.String("db", "8rinks.db", "Path to the SQLite database the schedule is stored in")
+	var opts sinkOptions
+	opts.register(fs, "google")
+	var dryRun = fs.Bool("dry-run", false, "Print the changes the sync would make to the calendar without making them")
+	var planFormat = fs.String("plan-format", "text", "Format the -dry-run plan is printed in, text or json")
+	var site siteFlags
+	site.register(fs)
+	fs.Parse(args)
+
+	cfg, err := configure(fs, *configPath)
+	if err != nil {
+		return err
+	}
+	if err := site.apply(); err != nil {
+		return err
+	}
+
+	if *planFormat != "text" && *planFormat != "json" {
+		return fmt.Errorf("unknown plan format %s, expected text or json", *planFormat)
+	}
+	teams, err := syncTeams(cfg, fs, *teamName, *profileName, opts)
+	if err != nil {
+		return err
+	}
+
+	store, err := OpenStore(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	for _, team := range teams {
+		result, _, err := scrapeAndSave(ctx, store, team.Team)
+		if err != nil {
+			return err
+		}
+		for _, s := range team.Syncs {
+			if s.Profile != "" {
+				log.Infof("Syncing %s to the %s calendar of profile %s", result.TeamName, s.Sink.Sink, s.Profile)
+			}
+			plan, err := syncTeam(ctx, store, s.Sink, result, *dryRun)
+			if err != nil {
+				return err
+			}
+			if *dryRun {
+				if err := printSyncPlan(os.Stdout, plan, *planFormat); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// syncTeams returns the teams to sync and the calendars to sync them to. With -tn
+// the team is synced to the sinks of the flags or the top of the config file,
+// otherwise the teams of the config file are synced to their profiles' sinks.
+func syncTeams(cfg *config, fs *flag.FlagSet, teamName string, profileName string, opts sinkOptions) ([]followedTeam, error) {
+
+	if flagGiven(fs, "tn") || len(cfg.teamRefs()) == 0 {
+		if profileName != "" {
+			return nil, fmt.Errorf("-profile needs the profiles of a config file, not -tn")
+		}
+		sinks := []sinkOptions{opts}
+		if !flagGiven(fs, "sink") && len(cfg.Sinks) > 0 {
+			var err error
+			if sinks, err = cfg.sinkOptions(); err != nil {
+				return nil, err
+			}
+		}
+		team := followedTeam{Team: teamRef{Name: teamName}}
+		for _, o := range sinks {
+			if err := o.validate(); err != nil {
+				return nil, err
+			}
+			team.Syncs = append(team.Syncs, profileSink{Sink: o})
+		}
+		return []followedTeam{team}, nil
+	}
+
+	profiles, err := cfg.profiles([]sinkOptions{opts}, flagGiven(fs, "sink"))
+	if err != nil {
+		return nil, err
+	}
+	if profileName != "" {
+		var chosen []profile
+		for _, p := range profiles {
+			if p.Name == profileName {
+				chosen = append(chosen, p)
+			}
+		}
+		if len(chosen) == 0 {
+			return nil, fmt.Errorf("there is no profile %s in the config file", profileName)
+		}
+		profiles = chosen
+	}
+	return followedTeams(profiles), nil
+}
+
+// syncTeam syncs the stored games of a scraped team to the calendar the options
+// describe
+func syncTeam(ctx context.Context, store *Store, opts sinkOptions, result scrapeResult, dryRun bool) (syncPlan, error) {
+
+	games, err := store.CalendarGames(result.SeasonID, result.TeamID)
+	if err != nil {
+		return syncPlan{}, err
+	}
+	sink, err := opts.open(ctx, result.TeamName, dryRun)
+	if err != nil {
+		return syncPlan{}, err
+	}
+	return reconcile(ctx, sink, result.TeamID, result.SeasonID, games, dryRun)
+}
+
+// sinkOptions are the flags that choose the calendar a team is synced to, and how
+// to sign in to it
+type sinkOptions struct {
+	Sink string
+
+	ICSFile string
+
+	CalDAVURL      string
+	CalDAVUser     string
+	CalDAVPassword string // from the config file, the environment if empty
+	CalDAVAuth     string
+
+	GoogleCalendar string
+	TeamCalendar   bool
+	Share          stringList
+	GoogleAuth     googleAuth
+	GoogleToken    string
+
+	MSClientID string
+	MSTenant   string
+	MSCalendar string
+	MSToken    string
+	GraphURL   string
+
+	// The tokens of a profile are kept apart from everyone else's
+	TokenDir        string // the directory tokens are kept in, the user config directory if empty
+	TokenPassphrase string // overrides the passphrase from the environment
+}
+
+// register adds the sink flags to fs, with sink as the default sink
+func (o *sinkOptions) register(fs *flag.FlagSet, sink string) {
+	fs.StringVar(&o.Sink, "sink", sink, "Calendar to sync to: google, graph for Outlook, caldav, ics to keep -ics-file up to date, or stdout")
+	fs.StringVar(&o.ICSFile, "ics-file", "", "Path of the iCalendar file the ics sink writes (default the team name with .ics)")
+	fs.StringVar(&o.CalDAVURL, "caldav-url", "", "URL of the CalDAV calendar collection to sync to")
+	fs.StringVar(&o.CalDAVUser, "caldav-user", "", "CalDAV username, the password is read from "+caldavPasswordEnv)
+	fs.StringVar(&o.CalDAVAuth, "caldav-auth", "auto", "How to authenticate with the CalDAV server: basic, digest, or auto to answer its challenge")
+	fs.StringVar(&o.GoogleCalendar, "calendar", "primary", "ID of the Google calendar to sync to")
+	fs.BoolVar(&o.TeamCalendar, "team-calendar", false, "Sync to a calendar of the team's own, created if needed, instead of -calendar")
+	fs.Var(&o.Share, "share", "Email to share the team calendar with read-only, may be repeated")
+	fs.StringVar(&o.GoogleAuth.Method, "auth", "auto", "How to authenticate with Google: oauth, service-account, or auto to go by the credentials")
+	fs.StringVar(&o.GoogleAuth.Credentials, "credentials", "", "Path to the Google OAuth client or service account key (default $"+googleCredentialsEnv+")")
+	fs.StringVar(&o.GoogleAuth.Impersonate, "impersonate", "", "Email of the user a service account with domain-wide delegation acts as")
+	fs.StringVar(&o.GoogleAuth.Flow, "auth-flow", "auto", "How to authorize with Google: browser, or auto to print the link to forward over SSH on headless machines")
+	fs.StringVar(&o.GoogleToken, "token", "", "Path the Google OAuth token is stored in (default google-token.json in the user config directory)")
+	fs.StringVar(&o.MSClientID, "ms-client-id", "", "Application ID of the Azure AD app the graph sink signs in with")
+	fs.StringVar(&o.MSTenant, "ms-tenant", "common", "Azure AD tenant the graph sink signs in to")
+	fs.StringVar(&o.MSCalendar, "ms-calendar", "", "ID of the Outlook calendar to sync to (default the user's calendar)")
+	fs.StringVar(&o.MSToken, "ms-token", "", "Path the Microsoft token is stored in (default microsoft-token.json in the user config directory)")
+	fs.StringVar(&o.GraphURL, "graph-url", graphURL, "Base URL of the Microsoft Graph API")
+}
+
+// validate checks the options make sense before anything is scraped
+func (o *sinkOptions) validate() error {
+	switch o.Sink {
+	case "", "google", "graph", "ics", "stdout":
+	case "caldav":
+		if o.CalDAVURL == "" {
+			return fmt.Errorf("the caldav sink needs -caldav-url")
+		}
+	default:
+		return fmt.Errorf("unknown sink %s, expected google, graph, caldav, ics or stdout", o.Sink)
+	}
+	if len(o.Share) > 0 && !o.TeamCalendar {
+		return fmt.Errorf("-share needs -team-calendar, other calendars are never shared")
+	}
+	if o.Sink == "google" || o.Sink == "" {
+		switch o.GoogleAuth.Flow {
+		case "", "auto", "browser":
+		case "device":
+			return fmt.Errorf("Google doesn't allow calendar access with the device flow, use -auth-flow auto and forward the port it prints over SSH, or a service account")
+		default:
+			return fmt.Errorf("unknown auth flow %s, expected browser or auto", o.GoogleAuth.Flow)
+		}
+	}
+	return nil
+}
+
+// open returns the sink for the team's calendar, signing in to it if it needs it
+func (o *sinkOptions) open(ctx context.Context, teamName string, dryRun bool) (CalendarSink, error) {
+
+	name := calendarName(teamName)
+	switch o.Sink {
+	case "google":
+		auth := o.GoogleAuth
+		var err error
+		auth.Tokens, err = o.tokenStore(o.GoogleToken, "google-token.json")
+		if err != nil {
+			return nil, err
+		}
+		srv, err := newCalendarService(ctx, auth)
+		if err != nil {
+			return nil, err
+		}
+		if !o.TeamCalendar {
+			return newGoogleSink(srv, o.GoogleCalendar), nil
+		}
+		if dryRun {
+			// Look the team calendar up without creating it, a calendar that
+			// doesn't exist yet is planned as empty
+			calendarID, err := findTeamCalendar(ctx, srv, name)
+			if err != nil {
+				return nil, err
+			}
+			if calendarID == "" {
+				return newPendingGoogleSink(name), nil
+			}
+			return newGoogleSink(srv, calendarID), nil
+		}
+		calendarID, err := ensureTeamCalendar(ctx, srv, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := shareCalendar(ctx, srv, calendarID, o.Share); err != nil {
+			return nil, err
+		}
+		return newGoogleSink(srv, calendarID), nil
+	case "graph":
+		tokens, err := o.tokenStore(o.MSToken, "microsoft-token.json")
+		if err != nil {
+			return nil, err
+		}
+		client, err := newGraphClient(ctx, o.MSClientID, o.MSTenant, tokens)
+		if err != nil {
+			return nil, err
+		}
+		return newGraphSink(client, o.GraphURL, o.MSCalendar), nil
+	case "caldav":
+		password := o.CalDAVPassword
+		if password == "" {
+			password = os.Getenv(caldavPasswordEnv)
+		}
+		return newCalDAVSink(o.CalDAVURL, o.CalDAVUser, password, o.CalDAVAuth)
+	case "ics":
+		path := o.ICSFile
+		if path == "" {
+			path = teamName + ".ics"
+		}
+		return newICSFileSink(path, name), nil
+	case "stdout":
+		return newICSWriterSink(os.Stdout, name), nil
+	}
+	return nil, fmt.Errorf("unknown sink %s", o.Sink)
+}
+
+// tokenStore returns the store for the token at path, or for the named file in
+// the token directory
+func (o *sinkOptions) tokenStore(path string, name string) (*tokenStore, error) {
+	if path == "" && o.TokenDir != "" {
+		path = filepath.Join(o.TokenDir, name)
+	}
+	ts, err := newTokenStore(path, name)
+	if err != nil {
+		return nil, err
+	}
+	if o.TokenPassphrase != "" {
+		ts.Passphrase = o.TokenPassphrase
+	}
+	return ts, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// tokenPassphraseEnv names the environment variable holding the passphrase tokens
+// are encrypted with. Tokens are stored in plain JSON when it isn't set.
+const tokenPassphraseEnv = "EIGHTRINKS_TOKEN_PASSPHRASE"
+
+// tokenStore keeps an OAuth token in a file. With a passphrase the token is
+// encrypted with AES-GCM, using a key derived from the passphrase with scrypt.
+type tokenStore struct {
+	Path       string
+	Passphrase string
+}
+
+// encryptedToken is the file format of an encrypted token
+type encryptedToken struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// newTokenStore returns a store for the token at path, or for the named file in
+// the user's config directory if path is empty
+func newTokenStore(path string, name string) (*tokenStore, error) {
+	if path == "" {
+		dir, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, name)
+	}
+	return &tokenStore{Path: path, Passphrase: os.Getenv(tokenPassphraseEnv)}, nil
+}
+
+// configDir returns the directory the app keeps its config and tokens in
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding the user config directory, %v", err)
+	}
+	return filepath.Join(dir, "8rinks-scraper"), nil
+}
+
+// Load reads the token. The error satisfies os.IsNotExist if there is no token yet.
+func (ts *tokenStore) Load() (*oauth2.Token, error) {
+
+	b, err := ioutil.ReadFile(ts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var enc encryptedToken
+	if err := json.Unmarshal(b, &enc); err == nil && len(enc.Ciphertext) > 0 {
+		if ts.Passphrase == "" {
+			return nil, fmt.Errorf("token %s is encrypted, set %s to decrypt it", ts.Path, tokenPassphraseEnv)
+		}
+		gcm, err := tokenCipher(ts.Passphrase, enc.Salt)
+		if err != nil {
+			return nil, err
+		}
+		b, err = gcm.Open(nil, enc.Nonce, enc.Ciphertext, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting token %s, is the passphrase right? %v", ts.Path, err)
+		}
+	}
+
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, fmt.Errorf("error reading token %s, %v", ts.Path, err)
+	}
+	return tok, nil
+}
+
+// Save writes the token atomically, so that a crash mid-write can't leave a
+// truncated token behind
+func (ts *tokenStore) Save(tok *oauth2.Token) error {
+
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	if ts.Passphrase != "" {
+		enc := encryptedToken{Version: 1, Salt: make([]byte, 16)}
+		if _, err := rand.Read(enc.Salt); err != nil {
+			return err
+		}
+		gcm, err := tokenCipher(ts.Passphrase, enc.Salt)
+		if err != nil {
+			return err
+		}
+		enc.Nonce = make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(enc.Nonce); err != nil {
+			return err
+		}
+		enc.Ciphertext = gcm.Seal(nil, enc.Nonce, b, nil)
+		if b, err = json.Marshal(enc); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFileAtomic(ts.Path, b, 0600); err != nil {
+		return fmt.Errorf("Unable to cache oauth token: %v", err)
+	}
+	log.Debugf("Save: saved token to %s", ts.Path)
+	return nil
+}
+
+// tokenCipher derives the token encryption key from the passphrase
+func tokenCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path once it has been synced
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // a no-op once it has been renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistingTokenSource saves the token every time the wrapped source refreshes
+// it, so the next run starts with a valid access token and the latest refresh
+// token
+type persistingTokenSource struct {
+	src   oauth2.TokenSource
+	store *tokenStore
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+func newPersistingTokenSource(src oauth2.TokenSource, store *tokenStore, tok *oauth2.Token) *persistingTokenSource {
+	return &persistingTokenSource{src: src, store: store, last: tok}
+}
+
+// Token returns a valid token, saving it if it changed
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+
+	tok, err := p.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last == nil || tok.AccessToken != p.last.AccessToken || tok.RefreshToken != p.last.RefreshToken {
+		if err := p.store.Save(tok); err != nil {
+			// The token is still good for this run
+			log.Errorf("Token: %v", err)
+		}
+		p.last = tok
+	}
+	return tok, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenStoreEncryption(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "token.json")
+	tok := &oauth2.Token{AccessToken: "access-secret", RefreshToken: "refresh-secret", TokenType: "Bearer", Expiry: time.Date(2019, time.September, 12, 19, 0, 0, 0, time.UTC)}
+
+	store := &tokenStore{Path: path, Passphrase: "correct horse"}
+	if err := store.Save(tok); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("the token is written in the clear, %s", b)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got %v, %v, want a file only the user can read", info.Mode(), err)
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != tok.AccessToken || got.RefreshToken != tok.RefreshToken || !got.Expiry.Equal(tok.Expiry) {
+		t.Errorf("loaded %+v, saved %+v", got, tok)
+	}
+
+	wrong := &tokenStore{Path: path, Passphrase: "battery staple"}
+	if _, err := wrong.Load(); err == nil || !strings.Contains(err.Error(), "passphrase") {
+		t.Errorf("got %v with the wrong passphrase, want it to fail to decrypt", err)
+	}
+	none := &tokenStore{Path: path}
+	if _, err := none.Load(); err == nil || !strings.Contains(err.Error(), tokenPassphraseEnv) {
+		t.Errorf("got %v without a passphrase, want to be told to set %s", err, tokenPassphraseEnv)
+	}
+}
+
+func TestTokenStoreLoadsPlainToken(t *testing.T) {
+
+	// A token saved before tokens were encrypted, as the oauth2 package writes it
+	path := filepath.Join(t.TempDir(), "token.json")
+	legacy := `{"access_token":"access","token_type":"Bearer","refresh_token":"refresh","expiry":"2019-09-12T19:00:00Z"}`
+	if err := ioutil.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, passphrase := range []string{"", "correct horse"} {
+		store := &tokenStore{Path: path, Passphrase: passphrase}
+		tok, err := store.Load()
+		if err != nil {
+			t.Errorf("passphrase %q: %v", passphrase, err)
+			continue
+		}
+		if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+			t.Errorf("passphrase %q: loaded %+v", passphrase, tok)
+		}
+	}
+
+	missing := &tokenStore{Path: filepath.Join(t.TempDir(), "token.json")}
+	if _, err := missing.Load(); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing token, want it not to exist", err)
+	}
+}
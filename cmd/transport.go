@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// siteClient sends every request the scraper makes to the facility site, so they
+// all share its retries and rate limit
+var siteClient = newScrapeClient()
+
+// schedulePageURL is the page the schedule is scraped from, both fetched and
+// posted back to. The config file may point it at another facility.
+var schedulePageURL = defaultSchedulePageURL
+
+const (
+	// defaultSchedulePageURL is the schedule page of 8 Rinks
+	defaultSchedulePageURL = "https://canlanaisl.icesports.com/BURNABY8RINKS/soccer-schedule.aspx"
+	// defaultUserAgent identifies the scraper to the site
+	defaultUserAgent = "8rinks-scraper/1.0"
+	// userAgentEnv names the environment variable that overrides the User-Agent
+	userAgentEnv = "EIGHTRINKS_USER_AGENT"
+)
+
+// scrapeClient sends requests to the facility site politely and resiliently. Each
+// attempt has its own timeout, server errors and network errors of idempotent
+// requests are retried with exponential backoff and full jitter, and a token
+// bucket shared by every request keeps the request rate down.
+type scrapeClient struct {
+	Client     *http.Client
+	UserAgent  string
+	Timeout    time.Duration // for each attempt, including reading the body
+	Attempts   int
+	Backoff    time.Duration // the most the first retry waits, doubled after every attempt
+	MaxBackoff time.Duration
+	Limiter    *tokenBucket
+	Cache      *diskCache // nil when responses aren't cached
+	Clock      clock      // waits between attempts
+}
+
+// clock tells the time and waits, so tests can stand in for the system clock
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the clock of the system
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// newScrapeClient returns a client with defaults suited to the facility site
+func newScrapeClient() *scrapeClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	// Compression is negotiated and decoded here rather than by the transport,
+	// which only knows gzip
+	transport.DisableCompression = true
+	userAgent := os.Getenv(userAgentEnv)
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	return &scrapeClient{
+		Client:     &http.Client{Transport: transport},
+		UserAgent:  userAgent,
+		Timeout:    45 * time.Second,
+		Attempts:   4,
+		Backoff:    time.Second,
+		MaxBackoff: 30 * time.Second,
+		Limiter:    newTokenBucket(1, 2),
+		Clock:      systemClock{},
+	}
+}
+
+// Do sends the request, retrying it when that is worth it. The body of the
+// response is read in full before it is returned, so the timeout covers it and a
+// body cut short is retried too. Only idempotent requests are retried, and those
+// with a body must be replayable, which they are when made by http.NewRequest
+// from a bytes or strings reader. With a
+// cache, GETs are sent as conditional requests and answered from it when the
+// page hasn't changed.
+func (c *scrapeClient) Do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if c.Cache != nil && req.Method == "GET" {
+		return c.cachedGet(ctx, req)
+	}
+	return c.send(ctx, req)
+}
+
+// send sends the request with retries, bypassing the cache
+func (c *scrapeClient) send(ctx context.Context, req *http.Request) (*http.Response, error) {
+
+	backoff := c.Backoff
+	var err error
+	for attempt := 1; attempt <= c.Attempts; attempt++ {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		var resp *http.Response
+		var retryAfter time.Duration
+		resp, retryAfter, err = c.attempt(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil || retryAfter < 0 || !idempotent(req) || attempt == c.Attempts {
+			break
+		}
+
+		// Full jitter, anywhere up to the backoff, unless the server said when
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		log.Warnf("Do: attempt %d of %s %s failed, retrying in %v, %v", attempt, req.Method, req.URL, wait.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.Clock.After(wait):
+		}
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+	return nil, err
+}
+
+// idempotent reports whether sending the request again can't do any harm. A POST
+// that only reads, like the schedule postback, is marked with an Idempotency-Key
+// header without a value, as net/http does for its own retries.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = req.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
+
+// attempt sends the request once. A failure is retried unless retryAfter is
+// negative, and after retryAfter rather than the backoff if it is positive.
+func (c *scrapeClient) attempt(ctx context.Context, req *http.Request) (resp *http.Response, retryAfter time.Duration, err error) {
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	r := req.Clone(ctx)
+	if req.GetBody != nil {
+		if r.Body, err = req.GetBody(); err != nil {
+			return nil, -1, err
+		}
+	}
+	r.Header.Set("User-Agent", c.UserAgent)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	resp, err = c.Client.Do(r)
+	if errors.Is(err, errNotRecorded) {
+		return nil, -1, err
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading response to %s %s, %v", req.Method, req.URL, err)
+	}
+	if body, err = decodeBody(resp.Header.Get("Content-Encoding"), body); err != nil {
+		return nil, 0, fmt.Errorf("error decoding response to %s %s, %v", req.Method, req.URL, err)
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Uncompressed = true
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After"), c.MaxBackoff), fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	case resp.StatusCode >= 500:
+		return nil, 0, fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	case resp.StatusCode >= 400:
+		return nil, -1, fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return resp, 0, nil
+}
+
+// decodeBody undoes the content coding of a response body. Deflate is meant to
+// be zlib wrapped, but some servers send it raw, so that is tried too.
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	case "deflate":
+		if zr, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			r = zr
+		} else {
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+	return ioutil.ReadAll(r)
+}
+
+// newSiteRequest returns a request for the facility site. A form is sent as the
+// urlencoded body, with its Content-Length, and the headers are the ones a browser
+// sends that the site looks at. The User-Agent and Accept-Encoding are set by
+// the client.
+func newSiteRequest(method string, target string, form url.Values) (*http.Request, error) {
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
+	}
+	return req, nil
+}
+
+// siteFlags are the flags every scraping command has for how the site is reached
+type siteFlags struct {
+	UserAgent string
+	Cache     bool
+	NoCache   bool
+	CacheDir  string
+	CacheTTL  time.Duration
+	Record    string
+	Replay    string
+}
+
+// register adds the site flags to fs
+func (f *siteFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.UserAgent, "user-agent", "", "User-Agent sent to the site (default $"+userAgentEnv+" or "+defaultUserAgent+")")
+	fs.BoolVar(&f.Cache, "cache", false, "Cache responses from the site, reusing the schedule of a team for -cache-ttl")
+	fs.BoolVar(&f.NoCache, "no-cache", false, "Always fetch from the site, neither reading nor writing the response cache, even with -cache")
+	fs.StringVar(&f.CacheDir, "cache-dir", defaultCacheDir(), "Directory responses from the site are cached in")
+	fs.DurationVar(&f.CacheTTL, "cache-ttl", 10*time.Minute, "How long the schedule of a team is reused before the site is asked again")
+	fs.StringVar(&f.Record, "record", "", "Directory to save every request to the site and its response in, with cookies redacted")
+	fs.StringVar(&f.Replay, "replay", "", "Directory of a -record recording to answer requests from instead of the site")
+}
+
+// apply sets up the site client as the flags describe. Responses are only cached
+// with -cache, so a schedule is never older than the run reading it unless asked
+// for. Recording and replaying bypass the cache, so every request is captured and
+// every answer is recorded.
+func (f *siteFlags) apply() error {
+
+	switch {
+	case f.Record != "" && f.Replay != "":
+		return fmt.Errorf("-record and -replay can't be used together")
+	case f.Record != "":
+		t, err := newRecordingTransport(f.Record, siteClient.Client.Transport)
+		if err != nil {
+			return err
+		}
+		siteClient.Client.Transport = t
+	case f.Replay != "":
+		t, err := newReplayTransport(f.Replay)
+		if err != nil {
+			return err
+		}
+		siteClient.Client.Transport = t
+	}
+
+	if f.UserAgent != "" {
+		siteClient.UserAgent = f.UserAgent
+	}
+	siteClient.Cache = nil
+	if f.Cache && !f.NoCache && f.Record == "" && f.Replay == "" && f.CacheDir != "" && f.CacheTTL > 0 {
+		siteClient.Cache = &diskCache{Dir: f.CacheDir, TTL: f.CacheTTL}
+	}
+	return nil
+}
+
+// parseRetryAfter returns how long a Retry-After header in seconds asks to wait,
+// no more than max, or zero if there isn't one
+func parseRetryAfter(value string, max time.Duration) time.Duration {
+	secs, err := strconv.Atoi(value)
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	if d := time.Duration(secs) * time.Second; d < max {
+		return d
+	}
+	return max
+}
+
+// tokenBucket limits how often requests are sent, allowing short bursts
+type tokenBucket struct {
+	rate  float64 // tokens added a second
+	burst float64
+
+	clock clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket that refills at rate tokens a second
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return newTokenBucketClock(rate, burst, systemClock{})
+}
+
+// newTokenBucketClock returns a full bucket that refills by the clock
+func newTokenBucketClock(rate float64, burst int, c clock) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), clock: c, tokens: float64(burst), last: c.Now()}
+}
+
+// Wait takes a token, waiting for one if the bucket is empty
+func (b *tokenBucket) Wait(ctx context.Context) error {
+
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	// Take the token now, going into debt if need be, so waiters queue up in order
+	b.tokens--
+	wait := time.Duration(0)
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		// Give the token back
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	case <-b.clock.After(wait):
+		return nil
+	}
+}
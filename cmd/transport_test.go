@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDecodeBody(t *testing.T) {
+
+	page := []byte("<html><body>Megpies FC</body></html>")
+	compress := func(w func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		zw := w(&buf)
+		zw.Write(page)
+		zw.Close()
+		return buf.Bytes()
+	}
+	gzipped := compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	zlibbed := compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })
+	deflated := compress(func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	})
+
+	tests := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"", page},
+		{"identity", page},
+		{"gzip", gzipped},
+		{" GZIP ", gzipped},
+		{"x-gzip", gzipped},
+		{"deflate", zlibbed},
+		// Raw deflate from servers that leave out the zlib wrapper
+		{"deflate", deflated},
+	}
+	for _, tt := range tests {
+		got, err := decodeBody(tt.encoding, tt.body)
+		if err != nil {
+			t.Errorf("%q: %v", tt.encoding, err)
+		} else if !bytes.Equal(got, page) {
+			t.Errorf("%q: decoded %q", tt.encoding, got)
+		}
+	}
+
+	if _, err := decodeBody("br", page); err == nil {
+		t.Errorf("decoded an unsupported encoding")
+	}
+	if _, err := decodeBody("gzip", page); err == nil {
+		t.Errorf("decoded a body that isn't gzipped")
+	}
+}
+
+// fakeClock stands in for the system clock. Waiting on it moves it on at once,
+// and the waits are kept.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestScrapeClientRetries(t *testing.T) {
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		if after := r.URL.Query().Get("retry-after"); after != "" {
+			w.Header().Set("Retry-After", after)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		marked bool // with an Idempotency-Key
+		hits   int32
+		waits  []time.Duration
+	}{
+		{"server error", "GET", "status=500", false, 4, nil},
+		{"not found", "GET", "status=404", false, 1, nil},
+		{"post", "POST", "status=500", false, 1, nil},
+		{"postback", "POST", "status=500", true, 4, nil},
+		{"retry after", "GET", "status=503&retry-after=7", false, 4, []time.Duration{7 * time.Second, 7 * time.Second, 7 * time.Second}},
+		{"retry after too long", "GET", "status=429&retry-after=3600", false, 4, []time.Duration{8 * time.Second, 8 * time.Second, 8 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		clock := &fakeClock{now: time.Date(2019, time.September, 12, 19, 0, 0, 0, time.UTC)}
+		c := newScrapeClient()
+		c.Backoff, c.MaxBackoff = time.Second, 8*time.Second
+		c.Clock = clock
+		c.Limiter = newTokenBucketClock(1000, 10, clock)
+		atomic.StoreInt32(&hits, 0)
+
+		req, err := newSiteRequest(tt.method, srv.URL+"/?"+tt.query, url.Values{"team": {"4153"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.marked {
+			req.Header["Idempotency-Key"] = nil
+		}
+		if _, err := c.Do(context.Background(), req); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		if hits := atomic.LoadInt32(&hits); hits != tt.hits {
+			t.Errorf("%s: sent %d times, want %d", tt.name, hits, tt.hits)
+		}
+		if len(clock.waits) != int(tt.hits)-1 {
+			t.Errorf("%s: waited %v between %d attempts", tt.name, clock.waits, tt.hits)
+		}
+		// Without a Retry-After the waits are jittered up to a backoff that doubles
+		backoff := c.Backoff
+		for i, wait := range clock.waits {
+			switch {
+			case tt.waits != nil && wait != tt.waits[i]:
+				t.Errorf("%s: wait %d is %v, want %v", tt.name, i+1, wait, tt.waits[i])
+			case tt.waits == nil && (wait < 0 || wait > backoff):
+				t.Errorf("%s: wait %d is %v, more than the backoff %v", tt.name, i+1, wait, backoff)
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func TestTokenBucketThrottles(t *testing.T) {
+
+	clock := &fakeClock{now: time.Date(2019, time.September, 12, 19, 0, 0, 0, time.UTC)}
+	b := newTokenBucketClock(2, 3, clock)
+	start := clock.Now()
+
+	// The burst goes at once, then a request every half a second
+	for i := 0; i < 7; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != 2*time.Second {
+		t.Errorf("7 requests took %v, want 2s", elapsed)
+	}
+	for _, wait := range clock.waits {
+		if wait != 500*time.Millisecond {
+			t.Errorf("waited %v, want 500ms", wait)
+		}
+	}
+
+	// An idle bucket fills up to the burst again, not beyond
+	clock.After(time.Hour)
+	clock.waits = nil
+	for i := 0; i < 4; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(clock.waits) != 1 {
+		t.Errorf("waited %v after idling, want only the fourth request to wait", clock.waits)
+	}
+
+	// A cancelled wait gives its token back
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	never := &tokenBucket{rate: 1, burst: 1, clock: blockedClock{clock}, last: clock.Now()}
+	if err := never.Wait(ctx); err != context.Canceled {
+		t.Errorf("got %v, want the wait cancelled", err)
+	}
+	if never.tokens != 0 {
+		t.Errorf("the bucket has %v tokens after a cancelled wait, want 0", never.tokens)
+	}
+}
+
+// blockedClock is a clock whose waits never end
+type blockedClock struct {
+	*fakeClock
+}
+
+func (blockedClock) After(d time.Duration) <-chan time.Time {
+	return nil
+}
+
+func TestSiteFlagsUserAgent(t *testing.T) {
+
+	userAgent, cache := siteClient.UserAgent, siteClient.Cache
+	defer func() { siteClient.UserAgent, siteClient.Cache = userAgent, cache }()
+
+	// The flag is one of the site flags every scraping command has
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	var site siteFlags
+	site.register(fs)
+	if err := fs.Parse([]string{"-user-agent", "Megpies/2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if siteClient.UserAgent != "Megpies/2.0" {
+		t.Errorf("sending User-Agent %s, want the flag's", siteClient.UserAgent)
+	}
+}